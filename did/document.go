@@ -1,5 +1,7 @@
 package did
 
+import "encoding/json"
+
 type Resolver interface {
 	Resolve(did string) (*Document, error)
 }
@@ -34,11 +36,13 @@ type ServiceEndpoint struct {
 }
 
 type PublicKey struct {
-	Id              string `json:"id"`
-	Type            string `json:"type"`
-	Controller      string `json:"controller"`
-	PublicKeyBase58 string `json:"publicKeyBase58,omitempty"`
-	EthereumAddress string `json:"ethereumAddress,omitempty"`
+	Id                 string          `json:"id"`
+	Type               string          `json:"type"`
+	Controller         string          `json:"controller"`
+	PublicKeyBase58    string          `json:"publicKeyBase58,omitempty"`
+	PublicKeyMultibase string          `json:"publicKeyMultibase,omitempty"`
+	PublicKeyJwk       json.RawMessage `json:"publicKeyJwk,omitempty"`
+	EthereumAddress    string          `json:"ethereumAddress,omitempty"`
 }
 
 type Authentication struct {
@@ -9,7 +9,9 @@ import (
 	"time"
 )
 
-func New(w wallet.Wallet) (*did.Document, error) {
+// New creates a peer DID document for a new key. Pass a wallet.Batch as w to
+// store the key only along with the records that refer to the DID.
+func New(w wallet.KeyCreator) (*did.Document, error) {
 	pk, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
 	if err != nil {
 		return nil, err
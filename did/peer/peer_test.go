@@ -23,3 +23,33 @@ func TestNew(t *testing.T) {
 	b, _ := json.MarshalIndent(ddoc, "", "\t")
 	log.Println(string(b))
 }
+
+func TestNewInBatch(t *testing.T) {
+	w, err := wallet.NewWallet("supersecret", wallet.NewInMemoryStorage())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	batch, err := w.NewBatch()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ddoc, err := New(batch)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = batch.Create(ddoc.Id, ddoc, wallet.WithType("did")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kid := ddoc.PublicKey[0].PublicKeyBase58
+	if w.KeyExists(kid) {
+		t.Fatal("Key stored before commit")
+	}
+	if err = batch.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !w.KeyExists(kid) {
+		t.Fatal("Key not stored")
+	}
+}
@@ -0,0 +1,56 @@
+package did
+
+import (
+	"errors"
+	"github.com/tetreaulttech/ssi/wallet"
+)
+
+// keyTypes maps verification method types to the wallet key types.
+var keyTypes = map[string]wallet.KeyType{
+	"Ed25519VerificationKey2018":        wallet.Ed25519VerificationKey2018Type,
+	"Ed25519VerificationKey2020":        wallet.Ed25519VerificationKey2018Type,
+	"X25519KeyAgreementKey2019":         wallet.X25519KeyAgreementKey2019Type,
+	"X25519KeyAgreementKey2020":         wallet.X25519KeyAgreementKey2019Type,
+	"EcdsaSecp256k1VerificationKey2019": wallet.EcdsaSecp256k1VerificationKey2019Type,
+	"EcdsaSecp256r1VerificationKey2019": wallet.EcdsaSecp256r1VerificationKey2019Type,
+}
+
+// WalletKey decodes the public key from its publicKeyJwk, publicKeyMultibase
+// or publicKeyBase58 property.
+func (k PublicKey) WalletKey() (*wallet.PublicKey, error) {
+	typ, known := keyTypes[k.Type]
+
+	var pk *wallet.PublicKey
+	var err error
+	switch {
+	case len(k.PublicKeyJwk) > 0:
+		pk, err = wallet.ParseJWK(k.PublicKeyJwk)
+	case k.PublicKeyMultibase != "":
+		pk, err = wallet.ParsePublicKeyMultibase(k.PublicKeyMultibase)
+	case k.PublicKeyBase58 != "":
+		if !known {
+			return nil, errors.New("unsupported public key type " + k.Type)
+		}
+		pk, err = wallet.ParsePublicKeyBase58(typ, k.PublicKeyBase58)
+	default:
+		return nil, errors.New("public key has no supported key material")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if known && pk.Type != typ {
+		return nil, errors.New("public key does not match its type " + k.Type)
+	}
+	return pk, nil
+}
+
+// Verify reports whether sig is a valid signature of data made with the
+// private key of k.
+func (k PublicKey) Verify(data []byte, sig []byte) (bool, error) {
+	pk, err := k.WalletKey()
+	if err != nil {
+		return false, err
+	}
+	return pk.Verify(data, sig), nil
+}
@@ -0,0 +1,50 @@
+package did
+
+import (
+	"github.com/tetreaulttech/ssi/wallet"
+	"testing"
+)
+
+func TestVerifyWithPublicKey(t *testing.T) {
+	w, err := wallet.NewWallet("supersecret", wallet.NewInMemoryStorage())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	kid, err := w.CreateKey(wallet.EcdsaSecp256k1VerificationKey2019Type)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sig, err := w.Sign(kid, []byte("message"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	pk, err := wallet.ParsePublicKeyBase58(wallet.EcdsaSecp256k1VerificationKey2019Type, kid)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	jwk, err := pk.JWK()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, k := range []PublicKey{
+		{Type: "EcdsaSecp256k1VerificationKey2019", PublicKeyBase58: kid},
+		{Type: "EcdsaSecp256k1VerificationKey2019", PublicKeyMultibase: pk.Multibase()},
+		{Type: "JsonWebKey2020", PublicKeyJwk: jwk},
+	} {
+		ok, err := k.Verify([]byte("message"), sig)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !ok {
+			t.Fatal("Signature did not validate")
+		}
+	}
+
+	_, err = PublicKey{Type: "Ed25519VerificationKey2018", PublicKeyMultibase: pk.Multibase()}.Verify([]byte("message"), sig)
+	if err == nil {
+		t.Fatal("Expected an error, got nil.")
+	}
+}
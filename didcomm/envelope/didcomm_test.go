@@ -1,12 +1,16 @@
 package envelope
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/tetreaulttech/ssi/wallet"
 	"log"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPackAndUnpackAuthenticated(t *testing.T) {
@@ -91,3 +95,117 @@ func TestPackAndUnpackAnonymous(t *testing.T) {
 func TestUnpackSignedUnencrypted(t *testing.T) {
 
 }
+
+func TestConcurrentPackAndUnpack(t *testing.T) {
+	w, err := wallet.NewWallet("supersecret", wallet.NewInMemoryStorage())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	senderKey, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	receiverKey, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		message := []byte(fmt.Sprintf("message %d", i))
+		sender := senderKey
+		if i%2 == 0 {
+			sender = ""
+		}
+
+		go func() {
+			defer wg.Done()
+			packed, err := Pack(w, message, []string{receiverKey}, sender)
+			if err != nil {
+				errs <- err
+				return
+			}
+			msg, err := Unpack(w, packed)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(msg) != string(message) {
+				errs <- fmt.Errorf("Expected: %s, Actual: %s", message, msg)
+			}
+		}()
+
+		// Keys are created and deleted while messages are packed
+		go func() {
+			defer wg.Done()
+			kid, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
+			if err == nil {
+				err = w.DeleteKey(kid)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err.Error())
+	}
+}
+
+// slowStorage adds the latency of a remote storage to every read.
+type slowStorage struct {
+	wallet.Storage
+}
+
+func (s slowStorage) Read(ctx context.Context, id string) (wallet.Item, error) {
+	time.Sleep(time.Millisecond)
+	return s.Storage.Read(ctx, id)
+}
+
+func benchmarkPackAndUnpack(b *testing.B, s wallet.Storage, opts ...wallet.Option) {
+	w, err := wallet.NewWallet("supersecret", s, opts...)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	senderKey, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	receiverKey, err := w.CreateKey(wallet.Ed25519VerificationKey2018Type)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		packed, err := Pack(w, []byte("oh hey there!"), []string{receiverKey}, senderKey)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		if _, err = Unpack(w, packed); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkPackAndUnpack(b *testing.B) {
+	benchmarkPackAndUnpack(b, wallet.NewInMemoryStorage())
+}
+
+func BenchmarkPackAndUnpackWithKeyCache(b *testing.B) {
+	benchmarkPackAndUnpack(b, wallet.NewInMemoryStorage(), wallet.WithKeyCache(16, time.Minute))
+}
+
+func BenchmarkPackAndUnpackSlowStorage(b *testing.B) {
+	benchmarkPackAndUnpack(b, slowStorage{wallet.NewInMemoryStorage()})
+}
+
+func BenchmarkPackAndUnpackSlowStorageWithKeyCache(b *testing.B) {
+	benchmarkPackAndUnpack(b, slowStorage{wallet.NewInMemoryStorage()}, wallet.WithKeyCache(16, time.Minute))
+}
@@ -3,6 +3,7 @@ module github.com/tetreaulttech/ssi
 go 1.13
 
 require (
+	github.com/btcsuite/btcd v0.20.1-beta
 	github.com/btcsuite/btcutil v1.0.2
 	github.com/go-resty/resty/v2 v2.3.0
 	github.com/gorilla/mux v1.7.4
@@ -10,5 +11,7 @@ require (
 	github.com/mitchellh/mapstructure v1.3.2
 	github.com/stretchr/testify v1.6.1
 	github.com/teserakt-io/golang-ed25519 v0.0.0-20200315192543-8255be791ce4
+	github.com/tyler-smith/go-bip39 v1.0.2
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 )
@@ -0,0 +1,344 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrorAuditLogTampered is returned, wrapped with the entry at fault, when
+// VerifyAuditLog finds that the audit log was changed.
+var ErrorAuditLogTampered = errors.New("audit log was tampered with")
+
+var errorAuditLogDisabled = errors.New("wallet has no audit log")
+
+var errorAuditRecord = errors.New("audit log records can only be read with ReadAuditLog")
+
+// AuditOperation is a key operation recorded in the audit log.
+type AuditOperation string
+
+const (
+	AuditSign      AuditOperation = "sign"
+	AuditSeal      AuditOperation = "seal"
+	AuditOpen      AuditOperation = "open"
+	AuditCreateKey AuditOperation = "createKey"
+	AuditDeleteKey AuditOperation = "deleteKey"
+	AuditRotateKey AuditOperation = "rotateKey"
+
+	// AuditRepair records a RepairAuditLog, with the damage it found as the
+	// error.
+	AuditRepair AuditOperation = "repairAuditLog"
+)
+
+// AuditEntry records one key operation. Hash is the SHA-256 of PrevHash,
+// the hash of the entry before it, and of the other fields, so that
+// entries cannot be changed, removed or reordered without breaking the
+// chain.
+type AuditEntry struct {
+	Seq       uint64         `json:"seq"`
+	Time      time.Time      `json:"time"`
+	Operation AuditOperation `json:"operation"`
+	KeyID     string         `json:"keyId"`
+	Caller    string         `json:"caller,omitempty"`
+
+	// Error is set if the operation failed.
+	Error string `json:"error,omitempty"`
+
+	PrevHash []byte `json:"prevHash,omitempty"`
+	Hash     []byte `json:"hash"`
+}
+
+func (e *AuditEntry) hash() []byte {
+	fields := *e
+	fields.PrevHash = nil
+	fields.Hash = nil
+	b, _ := json.Marshal(fields)
+
+	h := sha256.New()
+	h.Write(e.PrevHash)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// auditHead points at the last entry of the audit log, so that removing
+// entries from the end is detected too.
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash []byte `json:"hash,omitempty"`
+}
+
+// The records of the audit log are kept apart from the keys under "_local/",
+// and out of reach of the record API, which refuses ids under auditPrefix.
+const (
+	auditPrefix        = "_audit/"
+	auditHeadId        = "_audit/head"
+	auditHeadType      = "_audit/head"
+	auditEntryIdPrefix = "_audit/entry/"
+	auditEntryIdFmt    = auditEntryIdPrefix + "%020d"
+	auditEntryType     = "_audit/entry"
+)
+
+func isAuditRecord(id string) bool {
+	return strings.HasPrefix(id, auditPrefix)
+}
+
+type callerKey struct{}
+
+// ContextWithCaller returns a context that identifies the caller, such as a
+// process or service name, in the audit log entries of the operations of a
+// wallet view returned by WithContext(ctx).
+func ContextWithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// audit appends an entry for op to the audit log, if the wallet keeps one.
+// The error of the operation, if any, is recorded in the entry, and replaced
+// by the error of appending the entry if that fails, so that no operation
+// goes unrecorded.
+func (w *wallet) audit(op AuditOperation, keyID string, err *error) {
+	if !w.auditLog {
+		return
+	}
+
+	entry := AuditEntry{Time: time.Now().UTC(), Operation: op, KeyID: keyID}
+	entry.Caller, _ = w.ctx.Value(callerKey{}).(string)
+	if *err != nil {
+		entry.Error = (*err).Error()
+	}
+
+	if aerr := w.appendAuditEntry(entry); aerr != nil {
+		*err = fmt.Errorf("audit log: %w", aerr)
+	}
+}
+
+// audit records the keys created and deleted by a committed batch, or that
+// its commit failed with *err.
+func (b *Batch) audit(err *error) {
+	var aerr error
+	record := func(op AuditOperation, id string) {
+		opErr := *err
+		b.w.audit(op, id, &opErr)
+		if opErr != *err && aerr == nil {
+			aerr = opErr
+		}
+	}
+	for _, id := range b.createdKeys {
+		record(AuditCreateKey, id)
+	}
+	for _, id := range b.deletedKeys {
+		record(AuditDeleteKey, id)
+	}
+	if aerr != nil {
+		*err = aerr
+	}
+}
+
+// auditOpen audits Open and OpenAnonymous, which report failure with res.
+func (w *wallet) auditOpen(receiverKey string, plaintext *[]byte, res *bool) {
+	var err error
+	if !*res {
+		err = errors.New("message cannot be opened")
+	}
+	w.audit(AuditOpen, receiverKey, &err)
+	if *res && err != nil {
+		*plaintext, *res = nil, false
+	}
+}
+
+// appendAuditEntry stores entry after the last one, together with the
+// updated head, retrying if another entry was appended concurrently.
+func (w *wallet) appendAuditEntry(entry AuditEntry) error {
+	var failed error
+	for {
+		var head auditHead
+		revision, err := w.readRevision(auditHeadId, &head)
+		if err != nil && err != ErrorNotFound {
+			return err
+		}
+
+		// Nothing was appended since the last attempt, which failed for
+		// another reason, such as an entry left past the head
+		if failed != nil && head.Seq+1 == entry.Seq {
+			return failed
+		}
+
+		entry.Seq = head.Seq + 1
+		entry.PrevHash = head.Hash
+		entry.Hash = entry.hash()
+
+		b := &Batch{w: w, metadata: w.metadata}
+		if err = b.create(fmt.Sprintf(auditEntryIdFmt, entry.Seq), entry, []RecordOption{WithType(auditEntryType)}); err != nil {
+			return err
+		}
+		head = auditHead{Seq: entry.Seq, Hash: entry.Hash}
+		if entry.Seq == 1 {
+			err = b.create(auditHeadId, head, []RecordOption{WithType(auditHeadType)})
+		} else {
+			var item Item
+			if item, err = w.updatedItem(auditHeadId, head, []RecordOption{WithRevision(revision)}); err == nil {
+				b.ops = append(b.ops, BatchOperation{Op: BatchUpdate, Item: item})
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		failed = b.commit()
+		if failed != ErrorConflict && failed != ErrorAlreadyExists {
+			return failed
+		}
+	}
+}
+
+// ReadAuditLog returns up to limit entries of the audit log, in order,
+// starting with entry from. The first entry is 1.
+func (w *wallet) ReadAuditLog(from uint64, limit int) ([]AuditEntry, error) {
+	if err := w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	if !w.auditLog {
+		return nil, errorAuditLogDisabled
+	}
+	if from == 0 {
+		from = 1
+	}
+
+	var head auditHead
+	if err := w.read(auditHeadId, &head); err != nil && err != ErrorNotFound {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0)
+	for seq := from; seq <= head.Seq && len(entries) < limit; seq++ {
+		var entry AuditEntry
+		if err := w.read(fmt.Sprintf(auditEntryIdFmt, seq), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// VerifyAuditLog checks the whole audit log, and returns
+// ErrorAuditLogTampered if an entry was changed, removed or reordered, or
+// entries were removed from the end. As the log is stored in the wallet, an
+// attacker able to restore an older copy of the storage as a whole can
+// still roll it back.
+func (w *wallet) VerifyAuditLog() error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	if !w.auditLog {
+		return errorAuditLogDisabled
+	}
+	return w.verifyAuditLog()
+}
+
+func (w *wallet) verifyAuditLog() error {
+	var head auditHead
+	if err := w.read(auditHeadId, &head); err != nil && err != ErrorNotFound {
+		return err
+	}
+
+	var prev []byte
+	for seq := uint64(1); seq <= head.Seq; seq++ {
+		var entry AuditEntry
+		err := w.read(fmt.Sprintf(auditEntryIdFmt, seq), &entry)
+		if err == ErrorNotFound {
+			return fmt.Errorf("%w: entry %d is missing", ErrorAuditLogTampered, seq)
+		} else if err != nil {
+			return err
+		}
+
+		if entry.Seq != seq || !bytes.Equal(entry.PrevHash, prev) || !bytes.Equal(entry.Hash, entry.hash()) {
+			return fmt.Errorf("%w: entry %d does not match its hash", ErrorAuditLogTampered, seq)
+		}
+		prev = entry.Hash
+	}
+
+	if !bytes.Equal(prev, head.Hash) {
+		return fmt.Errorf("%w: the last entry does not match the head", ErrorAuditLogTampered)
+	}
+
+	// Entries after the head were not reported as appended
+	var entry AuditEntry
+	if err := w.read(fmt.Sprintf(auditEntryIdFmt, head.Seq+1), &entry); err != ErrorNotFound {
+		if err == nil {
+			return fmt.Errorf("%w: entry %d follows the head", ErrorAuditLogTampered, head.Seq+1)
+		}
+		return err
+	}
+	return nil
+}
+
+// RepairAuditLog makes a damaged audit log usable again. A log whose head was
+// lost or left behind by tampering with the storage otherwise fails every
+// audited operation. The head is pointed at the last entry, and the repair
+// is recorded as an AuditRepair entry, with what VerifyAuditLog reported as
+// its error. Damage to the entries themselves is kept, and still reported by
+// VerifyAuditLog.
+func (w *wallet) RepairAuditLog() error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	if !w.auditLog {
+		return errorAuditLogDisabled
+	}
+	damage := w.verifyAuditLog()
+	if damage == nil {
+		return nil
+	}
+	if !errors.Is(damage, ErrorAuditLogTampered) {
+		return damage
+	}
+
+	var head auditHead
+	cursor := ""
+	for {
+		records, next, err := w.list(auditEntryType, cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if !strings.HasPrefix(r.ID, auditEntryIdPrefix) {
+				continue
+			}
+			var entry AuditEntry
+			if err = json.Unmarshal(r.Value, &entry); err != nil {
+				return err
+			}
+			if entry.Seq >= head.Seq {
+				head = auditHead{Seq: entry.Seq, Hash: entry.Hash}
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	revision, err := w.readRevision(auditHeadId, &auditHead{})
+	if err == ErrorNotFound {
+		err = w.create(auditHeadId, head, WithType(auditHeadType))
+	} else if err == nil {
+		err = w.update(auditHeadId, head, WithRevision(revision))
+	}
+	if err != nil {
+		return err
+	}
+
+	entry := AuditEntry{Time: time.Now().UTC(), Operation: AuditRepair, Error: damage.Error()}
+	entry.Caller, _ = w.ctx.Value(callerKey{}).(string)
+	return w.appendAuditEntry(entry)
+}
@@ -0,0 +1,311 @@
+package wallet
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Batch collects changes to records and keys that are written together by
+// Commit, so that either all of them are stored or none. Whether this holds
+// when the process fails during Commit depends on the storage:
+//
+//   - the in-memory and bolt storages apply a batch atomically;
+//   - CouchDB writes the batch with one _bulk_docs request and, if some of
+//     its documents are rejected, reverts the others with a second one.
+//     Readers can see the batch partially applied until then, and a crash
+//     in between leaves it so;
+//   - other storages that do not implement BatchStorage get the changes one
+//     at a time, with the applied ones undone if a later one fails and the
+//     same caveats as CouchDB.
+//
+// A batch can be passed to peer.New in place of the wallet, so that the keys
+// of a new DID are only stored along with the records that refer to them.
+//
+// A batch must not be used by several goroutines at once.
+type Batch struct {
+	w   *wallet
+	ops []BatchOperation
+
+	// metadata holds the keys the batch is encrypted with.
+	metadata *metadata
+
+	// createdKeys are recorded in the audit log.
+	createdKeys []string
+
+	// deletedKeys are removed from the key cache, and recorded in the audit
+	// log.
+	deletedKeys []string
+
+	// masterSeed is the wallet's master seed as advanced by CreateKey.
+	masterSeed         *masterSeed
+	masterSeedRevision string
+}
+
+// NewBatch starts a batch of changes to the wallet. It fails with
+// ErrorLocked while the wallet is locked.
+func (w *wallet) NewBatch() (*Batch, error) {
+	if err := w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	return &Batch{w: w, metadata: w.metadata}, nil
+}
+
+// Create adds the creation of a record to the batch.
+func (b *Batch) Create(id string, item interface{}, opts ...RecordOption) error {
+	if err := b.w.rlock(); err != nil {
+		return err
+	}
+	defer b.w.mu.RUnlock()
+
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
+	return b.create(id, item, opts)
+}
+
+func (b *Batch) create(id string, item interface{}, opts []RecordOption) error {
+	storageItem, err := b.w.newItem(id, item, opts)
+	if err != nil {
+		return err
+	}
+
+	b.ops = append(b.ops, BatchOperation{Op: BatchCreate, Item: storageItem})
+	return nil
+}
+
+// Update adds an update of a record to the batch. The record must not change
+// until the batch is committed, or Commit fails with ErrorConflict.
+func (b *Batch) Update(id string, item interface{}, opts ...RecordOption) error {
+	if err := b.w.rlock(); err != nil {
+		return err
+	}
+	defer b.w.mu.RUnlock()
+
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
+	storageItem, err := b.w.updatedItem(id, item, opts)
+	if err != nil {
+		return err
+	}
+
+	b.ops = append(b.ops, BatchOperation{Op: BatchUpdate, Item: storageItem})
+	return nil
+}
+
+// Delete adds the deletion of a record to the batch.
+func (b *Batch) Delete(id string) error {
+	if err := b.w.rlock(); err != nil {
+		return err
+	}
+	defer b.w.mu.RUnlock()
+
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
+	eid, err := encryptSearcheable(b.w.metadata.NameKey, b.w.metadata.HmacKey, []byte(id))
+	if err != nil {
+		return err
+	}
+
+	b.ops = append(b.ops, BatchOperation{Op: BatchDelete, Item: Item{ID: eid}})
+	if strings.HasPrefix(id, "_local/") {
+		b.deletedKeys = append(b.deletedKeys, strings.TrimPrefix(id, "_local/"))
+	}
+	return nil
+}
+
+// CreateKey creates a key like Wallet.CreateKey and returns its id. The key
+// is only stored when the batch is committed.
+func (b *Batch) CreateKey(typ KeyType, opts ...KeyOption) (string, error) {
+	if err := b.w.rlock(); err != nil {
+		return "", err
+	}
+	defer b.w.mu.RUnlock()
+	return b.createKey(typ, newKeyOptions(opts), "")
+}
+
+// createKey adds a new key to the batch, as the replacement of the key
+// replaces if it is set.
+func (b *Batch) createKey(typ KeyType, o keyOptions, replaces string) (string, error) {
+	var id string
+	var key *keyRecord
+	var err error
+
+	if typ == Ed25519VerificationKey2018Type {
+		if b.masterSeed == nil {
+			b.masterSeed, b.masterSeedRevision, err = b.w.readMasterSeedRevision()
+			if err != nil && err != ErrorNotFound {
+				return "", err
+			}
+		}
+		// Indexes already taken by keys from DeriveKey are skipped
+		for b.masterSeed != nil && key == nil {
+			id, key, err = deriveKeyRecord(typ, b.masterSeed.Seed, fmt.Sprintf(derivationPath, b.masterSeed.NextIndex))
+			if err != nil {
+				return "", err
+			}
+			b.masterSeed.NextIndex++
+
+			var existing keyRecord
+			_, err = b.w.readKeyRecord(id, &existing)
+			existing.zero()
+			if err == nil {
+				key.zero()
+				key = nil
+			} else if err != ErrorNotFound {
+				key.zero()
+				return "", err
+			}
+		}
+	}
+	if key == nil {
+		if id, key, err = generateKey(typ); err != nil {
+			return "", err
+		}
+	}
+
+	defer key.zero()
+	o.apply(key)
+	key.Created = time.Now().Unix()
+	key.Replaces = replaces
+	if err = b.create("_local/"+id, key, []RecordOption{WithType(keyRecordType)}); err != nil {
+		return "", err
+	}
+	b.createdKeys = append(b.createdKeys, id)
+	return id, nil
+}
+
+// DeleteKey adds the deletion of a key to the batch.
+func (b *Batch) DeleteKey(id string) error {
+	if err := b.w.rlock(); err != nil {
+		return err
+	}
+	var key keyRecord
+	_, err := b.w.readKeyRecord(id, &key)
+	b.w.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	key.zero()
+	return b.Delete("_local/" + id)
+}
+
+var errorRekeyed = errors.New("wallet was rekeyed or locked while the batch was built")
+
+// Commit writes the changes of the batch to storage. If it fails, for
+// instance with ErrorAlreadyExists or ErrorConflict, none of them are kept.
+func (b *Batch) Commit() (err error) {
+	if err = b.w.rlock(); err != nil {
+		return err
+	}
+	defer b.w.mu.RUnlock()
+	defer b.audit(&err)
+	return b.commit()
+}
+
+func (b *Batch) commit() error {
+	// Records encrypted before RekeyFull would be left under the discarded
+	// item key key, and Lock wipes the keys the batch was encrypted with
+	if b.metadata == nil || !hmac.Equal(b.w.metadata.ItemKeyKey, b.metadata.ItemKeyKey) {
+		return errorRekeyed
+	}
+
+	ops := b.ops
+	if b.masterSeed != nil {
+		item, err := b.w.updatedItem(masterSeedId, b.masterSeed, []RecordOption{WithRevision(b.masterSeedRevision)})
+		if err != nil {
+			return err
+		}
+		ops = append(ops, BatchOperation{Op: BatchUpdate, Item: item})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	var err error
+	if bs, ok := b.w.storage.(BatchStorage); ok {
+		err = bs.Batch(b.w.ctx, ops)
+	} else {
+		err = applyOperations(b.w.ctx, b.w.storage, ops)
+	}
+	if err == nil {
+		for _, id := range b.deletedKeys {
+			b.w.keys.remove(id)
+		}
+	}
+	return err
+}
+
+// applyOperations applies ops one at a time, undoing the applied ones when
+// one fails.
+func applyOperations(ctx context.Context, s Storage, ops []BatchOperation) error {
+	undo := make([]BatchOperation, 0, len(ops))
+	for _, op := range ops {
+		var err error
+		var previous Item
+		if op.Op != BatchCreate {
+			previous, err = s.Read(ctx, op.Item.ID)
+		}
+		if err == nil {
+			switch op.Op {
+			case BatchCreate:
+				err = s.Create(ctx, op.Item)
+			case BatchUpdate:
+				err = s.Update(ctx, op.Item)
+			case BatchDelete:
+				err = s.Delete(ctx, op.Item.ID)
+			}
+		}
+		if err != nil {
+			return rollback(s, undo, err)
+		}
+		undo = append(undo, inverse(op, previous))
+	}
+	return nil
+}
+
+// inverse returns the operation that undoes op, given the item it replaced.
+func inverse(op BatchOperation, previous Item) BatchOperation {
+	switch op.Op {
+	case BatchCreate:
+		return BatchOperation{Op: BatchDelete, Item: Item{ID: op.Item.ID}}
+	case BatchUpdate:
+		return BatchOperation{Op: BatchUpdate, Item: previous}
+	}
+	previous.Revision = ""
+	return BatchOperation{Op: BatchCreate, Item: previous}
+}
+
+// rollback applies the undo operations in reverse order and returns err. It
+// does not use the batch's context, so that a cancelled batch is still
+// reverted.
+func rollback(s Storage, undo []BatchOperation, err error) error {
+	ctx := context.Background()
+	for i := len(undo) - 1; i >= 0; i-- {
+		op := undo[i]
+		var uerr error
+		switch op.Op {
+		case BatchCreate:
+			uerr = s.Create(ctx, op.Item)
+		case BatchUpdate:
+			var current Item
+			if current, uerr = s.Read(ctx, op.Item.ID); uerr == nil {
+				op.Item.Revision = current.Revision
+				uerr = s.Update(ctx, op.Item)
+			}
+		case BatchDelete:
+			uerr = s.Delete(ctx, op.Item.ID)
+		}
+		if uerr != nil {
+			return fmt.Errorf("%w (rollback incomplete: %v)", err, uerr)
+		}
+	}
+	return err
+}
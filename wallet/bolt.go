@@ -0,0 +1,192 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.etcd.io/bbolt"
+	"strconv"
+	"time"
+)
+
+type boltStorage struct {
+	db *bbolt.DB
+}
+
+var boltBucket = []byte("items")
+
+// ErrorStorageLocked is returned when a storage file is in use by another process.
+var ErrorStorageLocked = errors.New("storage is locked by another process")
+
+const boltLockTimeout = time.Second
+
+// NewBoltStorage opens the embedded storage file at path, creating it if
+// needed. Writes are durable once they return, and the file is locked for
+// the lifetime of the storage so that only one process can use it at a time.
+// Close releases the file.
+func NewBoltStorage(path string) (Storage, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: boltLockTimeout})
+	if err == bbolt.ErrTimeout {
+		return nil, ErrorStorageLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+func (b *boltStorage) Create(ctx context.Context, item Item) error {
+	return b.Batch(ctx, []BatchOperation{{Op: BatchCreate, Item: item}})
+}
+
+func (b *boltStorage) Read(ctx context.Context, id string) (Item, error) {
+	var i Item
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		v := tx.Bucket(boltBucket).Get([]byte(id))
+		if v == nil {
+			return ErrorNotFound
+		}
+		return json.Unmarshal(v, &i)
+	})
+	return i, err
+}
+
+func (b *boltStorage) Update(ctx context.Context, item Item) error {
+	return b.Batch(ctx, []BatchOperation{{Op: BatchUpdate, Item: item}})
+}
+
+func (b *boltStorage) Delete(ctx context.Context, id string) error {
+	return b.Batch(ctx, []BatchOperation{{Op: BatchDelete, Item: Item{ID: id}}})
+}
+
+// Batch applies ops in a single transaction, which is rolled back if one of
+// them fails.
+func (b *boltStorage) Batch(ctx context.Context, ops []BatchOperation) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, op := range ops {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := boltApply(tx, op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltStorage) Search(ctx context.Context, typ string, q StorageQuery) ([]Item, error) {
+	items := make([]Item, 0)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var i Item
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			if i.Type == typ && q.Match(i.Tags) {
+				items = append(items, i)
+			}
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (b *boltStorage) List(ctx context.Context, typ string, cursor string, limit int) ([]Item, string, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	items := make([]Item, 0, limit)
+	next := ""
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		k, v := c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var i Item
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			if typ != "" && i.Type != typ {
+				continue
+			}
+			if len(items) == limit {
+				next = items[limit-1].ID
+				return nil
+			}
+			items = append(items, i)
+		}
+		return nil
+	})
+	return items, next, err
+}
+
+func (b *boltStorage) Close() error {
+	return b.db.Close()
+}
+
+func boltApply(tx *bbolt.Tx, op BatchOperation) error {
+	bucket := tx.Bucket(boltBucket)
+	v := bucket.Get([]byte(op.Item.ID))
+	switch op.Op {
+	case BatchCreate:
+		if v != nil {
+			return ErrorAlreadyExists
+		}
+	case BatchUpdate:
+		if v == nil {
+			return ErrorNotFound
+		}
+		var current Item
+		if err := json.Unmarshal(v, &current); err != nil {
+			return err
+		}
+		if current.Revision != op.Item.Revision {
+			return ErrorConflict
+		}
+	case BatchDelete:
+		if v == nil {
+			return ErrorNotFound
+		}
+		return bucket.Delete([]byte(op.Item.ID))
+	}
+	return boltPut(tx, op.Item)
+}
+
+// boltPut stores item under a new revision.
+func boltPut(tx *bbolt.Tx, item Item) error {
+	bucket := tx.Bucket(boltBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	item.Revision = strconv.FormatUint(seq, 10)
+
+	v, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(item.ID), v)
+}
@@ -1,98 +1,321 @@
 package wallet
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 type couchDBStorage struct {
-	url string
+	client *resty.Client
+	url    string
+	shared bool
 }
 
-func NewCouchDbStorage(dbname string) (Storage, error) {
-	databases := make([]string, 0)
+// CouchDBOption configures the connection of a CouchDB storage.
+type CouchDBOption func(*couchDBOptions)
+
+type couchDBOptions struct {
+	url        string
+	username   string
+	password   string
+	cookieAuth bool
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	httpClient *http.Client
+}
+
+const defaultCouchDBURL = "http://localhost:5984"
+
+// WithCouchDBURL sets the address of the CouchDB server. It defaults to
+// http://localhost:5984.
+func WithCouchDBURL(url string) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.url = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithBasicAuth sends the credentials with every request.
+func WithBasicAuth(username, password string) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.username = username
+		o.password = password
+		o.cookieAuth = false
+	}
+}
+
+// WithCookieAuth opens a session with the credentials and authenticates
+// requests with its cookie. An expired session is renewed on the next
+// request that is rejected with 401 Unauthorized.
+func WithCookieAuth(username, password string) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.username = username
+		o.password = password
+		o.cookieAuth = true
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for https URLs.
+func WithTLSConfig(config *tls.Config) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.tlsConfig = config
+	}
+}
+
+// WithRequestTimeout limits the duration of every request to the server.
+func WithRequestTimeout(timeout time.Duration) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithHTTPClient makes the storage send its requests with client, so that
+// its connection pool can be shared with other storages. The client is not
+// modified: WithRequestTimeout and WithTLSConfig apply to a copy of it, and
+// WithTLSConfig to a copy of its transport, whose connections are not
+// shared.
+func WithHTTPClient(client *http.Client) CouchDBOption {
+	return func(o *couchDBOptions) {
+		o.httpClient = client
+	}
+}
+
+// NewCouchDbStorage opens the CouchDB database dbname, creating it if it
+// does not exist yet. The storage reuses one HTTP client, and with it its
+// connections, for all its requests.
+func NewCouchDbStorage(dbname string, opts ...CouchDBOption) (Storage, error) {
+	o := couchDBOptions{url: defaultCouchDBURL}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var client *resty.Client
+	if o.httpClient != nil {
+		hc, err := o.sharedHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		client = resty.NewWithClient(hc)
+	} else {
+		client = resty.New()
+		if o.tlsConfig != nil {
+			client.SetTLSClientConfig(o.tlsConfig)
+		}
+		if o.timeout > 0 {
+			client.SetTimeout(o.timeout)
+		}
+	}
+
+	c := &couchDBStorage{client: client, url: fmt.Sprintf("%s/%s", o.url, dbname), shared: o.httpClient != nil}
+
+	if o.cookieAuth {
+		if o.httpClient == nil {
+			client.SetCookieJar(nil)
+		}
+		session := &couchDBSession{
+			client:   resty.NewWithClient(client.GetClient()),
+			url:      fmt.Sprintf("%s/_session", o.url),
+			username: o.username,
+			password: o.password,
+		}
+		if err := session.login(); err != nil {
+			return nil, err
+		}
+		client.OnBeforeRequest(session.authenticate)
+		client.OnAfterResponse(session.renew)
+		client.SetRetryCount(1)
+		client.AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return resp != nil && resp.StatusCode() == http.StatusUnauthorized && session.login() == nil
+		})
+	} else if o.username != "" {
+		client.SetBasicAuth(o.username, o.password)
+	}
 
 	// Make sure the database exists
-	resp, err := resty.New().R().
-		SetResult(databases).
-		Get("http://localhost:5984/_all_dbs")
+	resp, err := client.R().Head(c.url)
 	if err != nil {
 		return nil, err
 	}
-	if resp.IsError() {
+	if resp.StatusCode() == http.StatusOK {
+		return c, nil
+	}
+	if resp.StatusCode() != http.StatusNotFound {
 		return nil, errors.New(http.StatusText(resp.StatusCode()))
 	}
 
-	url := fmt.Sprintf("http://localhost:5984/%s", dbname)
+	// Database doesn't exist yet - lets create it!
+	resp, err = client.R().Put(c.url)
+	if err != nil {
+		return nil, err
+	}
+	// Another client may have created it in the meantime
+	if resp.IsError() && resp.StatusCode() != http.StatusPreconditionFailed {
+		return nil, errors.New(http.StatusText(resp.StatusCode()))
+	}
+
+	return c, nil
+}
 
-	for _, db := range databases {
-		if strings.Compare(db, dbname) == 0 {
-			return &couchDBStorage{url: url}, nil
+// sharedHTTPClient returns a copy of the client set with WithHTTPClient, with
+// the timeout and TLS configuration of the storage, leaving the client, which
+// other storages may use, unchanged. The copy shares the transport of the
+// client, and so its connections, unless the TLS configuration is set, which
+// needs a transport of its own.
+func (o *couchDBOptions) sharedHTTPClient() (*http.Client, error) {
+	hc := *o.httpClient
+	if hc.Transport == nil {
+		hc.Transport = http.DefaultTransport
+	}
+	if o.timeout > 0 {
+		hc.Timeout = o.timeout
+	}
+	if o.tlsConfig != nil {
+		transport, ok := hc.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("TLS configuration needs an *http.Transport")
 		}
+		transport = transport.Clone()
+		transport.TLSClientConfig = o.tlsConfig
+		hc.Transport = transport
 	}
+	return &hc, nil
+}
 
-	// Database doesn't exist yet - lets create it!
-	resp, err = resty.New().R().
-		Put(url)
+// couchDBSession keeps the cookie of a CouchDB session and opens a new
+// session when it expires.
+type couchDBSession struct {
+	client   *resty.Client
+	url      string
+	username string
+	password string
+
+	mu     sync.Mutex
+	cookie *http.Cookie
+}
+
+const couchDBSessionCookie = "AuthSession"
+
+func (s *couchDBSession) login() error {
+	resp, err := s.client.R().
+		SetBody(map[string]string{"name": s.username, "password": s.password}).
+		Post(s.url)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if resp.IsError() {
-		return nil, errors.New(http.StatusText(resp.StatusCode()))
+		return errors.New(http.StatusText(resp.StatusCode()))
+	}
+	return s.renew(s.client, resp)
+}
+
+func (s *couchDBSession) authenticate(c *resty.Client, r *resty.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookie != nil {
+		r.Header.Set("Cookie", s.cookie.String())
+	}
+	return nil
+}
+
+// renew picks up the refreshed cookie CouchDB sends as a session nears its
+// expiry.
+func (s *couchDBSession) renew(c *resty.Client, resp *resty.Response) error {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == couchDBSessionCookie {
+			s.mu.Lock()
+			s.cookie = &http.Cookie{Name: cookie.Name, Value: cookie.Value}
+			s.mu.Unlock()
+		}
 	}
+	return nil
+}
 
-	return &couchDBStorage{url: url}, nil
+// CouchDB reserves the document ids that start with '_', which item ids,
+// being base64url ciphertexts, can. Such ids are stored with
+// couchDBIdEscape in front, and so are the ids that start with it, to tell
+// them apart. Documents stored before are left where they are, as none of
+// their ids could start with either.
+const couchDBIdEscape = "~"
+
+func couchDBDocID(id string) string {
+	if strings.HasPrefix(id, "_") || strings.HasPrefix(id, couchDBIdEscape) {
+		return couchDBIdEscape + id
+	}
+	return id
 }
 
-func (c *couchDBStorage) create(item item) error {
-	resp, err := resty.New().R().
+func couchDBItemID(docID string) string {
+	return strings.TrimPrefix(docID, couchDBIdEscape)
+}
+
+func (c *couchDBStorage) Create(ctx context.Context, item Item) error {
+	item.ID = couchDBDocID(item.ID)
+	resp, err := c.client.R().
+		SetContext(ctx).
 		SetBody(item).
 		Post(c.url)
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode() == http.StatusConflict {
+		return ErrorAlreadyExists
+	}
 	if resp.IsError() {
 		return errors.New(http.StatusText(resp.StatusCode()))
 	}
 	return nil
 }
 
-func (c *couchDBStorage) read(id string) (item, error) {
-	var i item
-	resp, err := resty.New().R().
+func (c *couchDBStorage) Read(ctx context.Context, id string) (Item, error) {
+	var i Item
+	resp, err := c.client.R().
+		SetContext(ctx).
 		SetResult(&i).
-		Get(fmt.Sprintf("%s/%s", c.url, id))
+		Get(fmt.Sprintf("%s/%s", c.url, url.PathEscape(couchDBDocID(id))))
 	if err != nil {
-		return item{}, err
+		return Item{}, err
 	}
 	if resp.StatusCode() == http.StatusNotFound {
-		return item{}, ErrorNotFound
+		return Item{}, ErrorNotFound
 	}
 	if resp.IsError() {
-		return item{}, errors.New(http.StatusText(resp.StatusCode()))
+		return Item{}, errors.New(http.StatusText(resp.StatusCode()))
 	}
+	i.ID = couchDBItemID(i.ID)
 	return i, nil
 }
 
-func (c *couchDBStorage) update(item item) error {
-	current, err := c.read(item.ID)
-	if err != nil {
-		return err
+func (c *couchDBStorage) Update(ctx context.Context, item Item) error {
+	// Without a revision CouchDB would create the document instead
+	if item.Revision == "" {
+		if _, err := c.Read(ctx, item.ID); err != nil {
+			return err
+		}
+		return ErrorConflict
 	}
 
-	item.Revision = current.Revision
-
-	resp, err := resty.New().R().
+	id := item.ID
+	item.ID = couchDBDocID(id)
+	resp, err := c.client.R().
+		SetContext(ctx).
 		SetBody(item).
-		Put(fmt.Sprintf("%s/%s", c.url, item.ID))
+		Put(fmt.Sprintf("%s/%s", c.url, url.PathEscape(item.ID)))
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode() == http.StatusNotFound {
-		return ErrorNotFound
+	if resp.StatusCode() == http.StatusConflict {
+		// CouchDB also reports a conflict for deleted documents
+		if _, err := c.Read(ctx, id); err != nil {
+			return err
+		}
+		return ErrorConflict
 	}
 	if resp.IsError() {
 		return errors.New(http.StatusText(resp.StatusCode()))
@@ -100,20 +323,251 @@ func (c *couchDBStorage) update(item item) error {
 	return nil
 }
 
-func (c *couchDBStorage) delete(id string) error {
-	item, err := c.read(id)
+func (c *couchDBStorage) Delete(ctx context.Context, id string) error {
+	item, err := c.Read(ctx, id)
 	if err != nil {
 		return err
 	}
 
-	resp, err := resty.New().R().
+	resp, err := c.client.R().
+		SetContext(ctx).
 		SetQueryParam("rev", item.Revision).
-		Delete(fmt.Sprintf("%s/%s", c.url, id))
+		Delete(fmt.Sprintf("%s/%s", c.url, url.PathEscape(couchDBDocID(id))))
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode() == http.StatusConflict {
+		return ErrorConflict
+	}
 	if resp.IsError() {
 		return errors.New(http.StatusText(resp.StatusCode()))
 	}
 	return nil
 }
+
+// couchDBDoc is an item as written to _bulk_docs, which marks deletions
+// with _deleted.
+type couchDBDoc struct {
+	Item
+	Deleted bool `json:"_deleted,omitempty"`
+}
+
+type bulkDocsResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// Batch writes ops with one _bulk_docs request. CouchDB applies each
+// document on its own, so if some are rejected the others are reverted with
+// a second request.
+func (c *couchDBStorage) Batch(ctx context.Context, ops []BatchOperation) error {
+	docs := make([]couchDBDoc, len(ops))
+	previous := make([]Item, len(ops))
+	for i, op := range ops {
+		docs[i] = couchDBDoc{Item: op.Item}
+		docs[i].ID = couchDBDocID(op.Item.ID)
+		if op.Op == BatchCreate {
+			docs[i].Revision = ""
+			continue
+		}
+
+		current, err := c.Read(ctx, op.Item.ID)
+		if err != nil {
+			return err
+		}
+		if op.Op == BatchUpdate && current.Revision != op.Item.Revision {
+			return ErrorConflict
+		}
+		if op.Op == BatchDelete {
+			docs[i] = couchDBDoc{Item: Item{ID: docs[i].ID, Revision: current.Revision}, Deleted: true}
+		}
+		current.ID = docs[i].ID
+		previous[i] = current
+	}
+
+	results, err := c.bulkDocs(ctx, docs)
+	if err != nil {
+		return err
+	}
+
+	// Every document that was written is reverted if one of them failed
+	var failed error
+	undo := make([]couchDBDoc, 0)
+	for i, result := range results {
+		var err error
+		switch {
+		case result.Error == "conflict" && ops[i].Op == BatchCreate:
+			err = ErrorAlreadyExists
+		case result.Error == "conflict":
+			err = ErrorConflict
+		case result.Error != "":
+			err = errors.New(result.Reason)
+		case ops[i].Op == BatchCreate:
+			undo = append(undo, couchDBDoc{Item: Item{ID: result.ID, Revision: result.Rev}, Deleted: true})
+		default:
+			previous[i].Revision = result.Rev
+			undo = append(undo, couchDBDoc{Item: previous[i]})
+		}
+		if failed == nil {
+			failed = err
+		}
+	}
+	if failed == nil || len(undo) == 0 {
+		return failed
+	}
+
+	// Revert even if the batch was cancelled
+	results, err = c.bulkDocs(context.Background(), undo)
+	if err == nil {
+		for _, result := range results {
+			if result.Error != "" {
+				err = errors.New(result.Reason)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%w (rollback incomplete: %v)", failed, err)
+	}
+	return failed
+}
+
+func (c *couchDBStorage) bulkDocs(ctx context.Context, docs []couchDBDoc) ([]bulkDocsResult, error) {
+	var results []bulkDocsResult
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"docs": docs}).
+		SetResult(&results).
+		Post(fmt.Sprintf("%s/_bulk_docs", c.url))
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New(http.StatusText(resp.StatusCode()))
+	}
+	return results, nil
+}
+
+func (c *couchDBStorage) Close() error {
+	if !c.shared {
+		c.client.GetClient().CloseIdleConnections()
+	}
+	return nil
+}
+
+type findRequest struct {
+	Selector map[string]interface{} `json:"selector"`
+	Limit    int                    `json:"limit"`
+	Bookmark string                 `json:"bookmark,omitempty"`
+}
+
+type findResponse struct {
+	Docs     []Item `json:"docs"`
+	Bookmark string `json:"bookmark"`
+}
+
+const findPageSize = 100
+
+func (c *couchDBStorage) Search(ctx context.Context, typ string, q StorageQuery) ([]Item, error) {
+	conditions := []interface{}{map[string]interface{}{"type": typ}}
+	if q.Op != QueryAnd || len(q.Queries) > 0 {
+		conditions = append(conditions, mangoSelector(q))
+	}
+
+	req := findRequest{
+		Selector: map[string]interface{}{"$and": conditions},
+		Limit:    findPageSize,
+	}
+
+	items := make([]Item, 0)
+	for {
+		var result findResponse
+		resp, err := c.client.R().
+			SetContext(ctx).
+			SetBody(req).
+			SetResult(&result).
+			Post(fmt.Sprintf("%s/_find", c.url))
+		if err != nil {
+			return nil, err
+		}
+		if resp.IsError() {
+			return nil, errors.New(http.StatusText(resp.StatusCode()))
+		}
+
+		for _, i := range result.Docs {
+			i.ID = couchDBItemID(i.ID)
+			items = append(items, i)
+		}
+		if len(result.Docs) < findPageSize {
+			return items, nil
+		}
+		req.Bookmark = result.Bookmark
+	}
+}
+
+// mangoSelector translates a compiled query into a CouchDB Mango selector.
+func mangoSelector(q StorageQuery) map[string]interface{} {
+	switch q.Op {
+	case QueryAnd, QueryOr:
+		selectors := make([]interface{}, len(q.Queries))
+		for i, sub := range q.Queries {
+			selectors[i] = mangoSelector(sub)
+		}
+		return map[string]interface{}{string(q.Op): selectors}
+	case QueryNot:
+		return map[string]interface{}{"$not": mangoSelector(q.Queries[0])}
+	}
+
+	field := "tags." + q.Name
+	switch q.Op {
+	case QueryNeq:
+		return map[string]interface{}{field: map[string]interface{}{"$exists": true, "$ne": q.Values[0]}}
+	case QueryIn:
+		return map[string]interface{}{field: map[string]interface{}{"$in": q.Values}}
+	}
+	return map[string]interface{}{field: map[string]interface{}{string(q.Op): q.Values[0]}}
+}
+
+func (c *couchDBStorage) List(ctx context.Context, typ string, cursor string, limit int) ([]Item, string, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	// Design documents are left out, so that the last document of a page is
+	// always an item whose id can be the next cursor
+	selector := map[string]interface{}{"_id": map[string]interface{}{"$gt": couchDBDocID(cursor), "$regex": "^[^_]"}}
+	if typ != "" {
+		selector["type"] = typ
+	}
+
+	req := map[string]interface{}{
+		"selector": selector,
+		"sort":     []interface{}{map[string]string{"_id": "asc"}},
+		"limit":    limit,
+	}
+
+	var result findResponse
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetBody(req).
+		SetResult(&result).
+		Post(fmt.Sprintf("%s/_find", c.url))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.IsError() {
+		return nil, "", errors.New(http.StatusText(resp.StatusCode()))
+	}
+
+	next := ""
+	if len(result.Docs) == limit {
+		next = couchDBItemID(result.Docs[limit-1].ID)
+	}
+
+	items := make([]Item, len(result.Docs))
+	for n, i := range result.Docs {
+		i.ID = couchDBItemID(i.ID)
+		items[n] = i
+	}
+	return items, next, nil
+}
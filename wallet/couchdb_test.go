@@ -0,0 +1,565 @@
+package wallet
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCouchDB is an in-memory stand-in for the parts of the CouchDB API
+// used by couchDBStorage: databases, documents with revisions, a subset of
+// Mango queries in _find, _bulk_docs, and basic and cookie authentication.
+// Deleted documents are kept as tombstones, and document ids starting with
+// '_' rejected, like CouchDB does.
+type fakeCouchDB struct {
+	mu        sync.Mutex
+	dbs       map[string]map[string]map[string]interface{}
+	revisions int
+	username  string
+	password  string
+	sessions  map[string]bool
+
+	connections int
+}
+
+func newFakeCouchDB(username, password string) (*fakeCouchDB, *httptest.Server) {
+	f := &fakeCouchDB{
+		dbs:      make(map[string]map[string]map[string]interface{}),
+		username: username,
+		password: password,
+		sessions: make(map[string]bool),
+	}
+	srv := httptest.NewUnstartedServer(f)
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.mu.Lock()
+			f.connections++
+			f.mu.Unlock()
+		}
+	}
+	srv.Start()
+	return f, srv
+}
+
+func (f *fakeCouchDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Like CouchDB, ids with a '/' must be escaped
+	path := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if path[0] == "_session" && r.Method == http.MethodPost {
+		f.login(w, r)
+		return
+	}
+	if !f.authorized(r) {
+		f.reply(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	db, ok := f.dbs[path[0]]
+	if len(path) == 1 {
+		switch {
+		case r.Method == http.MethodHead && ok:
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodHead:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && ok:
+			f.reply(w, http.StatusPreconditionFailed, map[string]string{"error": "file_exists"})
+		case r.Method == http.MethodPut:
+			f.dbs[path[0]] = make(map[string]map[string]interface{})
+			f.reply(w, http.StatusCreated, map[string]bool{"ok": true})
+		case !ok:
+			f.reply(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		case r.Method == http.MethodDelete:
+			delete(f.dbs, path[0])
+			f.reply(w, http.StatusOK, map[string]bool{"ok": true})
+		case r.Method == http.MethodPost:
+			var doc map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&doc)
+			if id := doc["_id"].(string); reservedDocID(id) {
+				f.reply(w, http.StatusBadRequest, illegalDocID)
+			} else {
+				status, result := f.write(db, id, doc)
+				f.reply(w, status, result)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if !ok {
+		f.reply(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		return
+	}
+
+	if len(path) > 2 {
+		f.reply(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		return
+	}
+	id, err := url.PathUnescape(path[1])
+	if err != nil {
+		f.reply(w, http.StatusBadRequest, map[string]string{"error": "bad_request"})
+		return
+	}
+	switch {
+	case id == "_find" && r.Method == http.MethodPost:
+		f.find(w, r, db)
+	case id == "_bulk_docs" && r.Method == http.MethodPost:
+		var req struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for _, doc := range req.Docs {
+			if reservedDocID(doc["_id"].(string)) {
+				f.reply(w, http.StatusBadRequest, illegalDocID)
+				return
+			}
+		}
+		results := make([]interface{}, len(req.Docs))
+		for i, doc := range req.Docs {
+			_, results[i] = f.write(db, doc["_id"].(string), doc)
+		}
+		f.reply(w, http.StatusCreated, results)
+	case r.Method == http.MethodGet:
+		if doc, ok := db[id]; ok && doc["_deleted"] != true {
+			f.reply(w, http.StatusOK, doc)
+		} else {
+			f.reply(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		}
+	case r.Method == http.MethodPut && reservedDocID(id):
+		f.reply(w, http.StatusBadRequest, illegalDocID)
+	case r.Method == http.MethodPut:
+		var doc map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&doc)
+		status, result := f.write(db, id, doc)
+		f.reply(w, status, result)
+	case r.Method == http.MethodDelete:
+		if doc, ok := db[id]; !ok || doc["_deleted"] == true {
+			f.reply(w, http.StatusNotFound, map[string]string{"error": "not_found"})
+		} else {
+			status, result := f.write(db, id, map[string]interface{}{"_rev": r.URL.Query().Get("rev"), "_deleted": true})
+			f.reply(w, status, result)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var illegalDocID = map[string]string{"error": "illegal_docid", "reason": "Only reserved document ids may start with underscore."}
+
+func reservedDocID(id string) bool {
+	return strings.HasPrefix(id, "_")
+}
+
+func (f *fakeCouchDB) authorized(r *http.Request) bool {
+	if f.username == "" {
+		return true
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return username == f.username && password == f.password
+	}
+	cookie, err := r.Cookie("AuthSession")
+	return err == nil && f.sessions[cookie.Value]
+}
+
+func (f *fakeCouchDB) login(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	json.NewDecoder(r.Body).Decode(&credentials)
+	if credentials.Name != f.username || credentials.Password != f.password {
+		f.reply(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	session := strconv.Itoa(len(f.sessions) + 1)
+	f.sessions[session] = true
+	http.SetCookie(w, &http.Cookie{Name: "AuthSession", Value: session, Path: "/"})
+	f.reply(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// expireSessions invalidates every cookie session.
+func (f *fakeCouchDB) expireSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.sessions {
+		f.sessions[s] = false
+	}
+}
+
+// write stores a new revision of a document, or a tombstone if the document
+// is marked deleted. The revision must be the current one, and may be
+// omitted if the document is new or deleted.
+func (f *fakeCouchDB) write(db map[string]map[string]interface{}, id string, doc map[string]interface{}) (int, map[string]interface{}) {
+	rev, _ := doc["_rev"].(string)
+	current, ok := db[id]
+	deleted := ok && current["_deleted"] == true
+	if ok && current["_rev"] != rev && !(deleted && rev == "") || !ok && rev != "" {
+		return http.StatusConflict, map[string]interface{}{"id": id, "error": "conflict", "reason": "Document update conflict."}
+	}
+
+	f.revisions++
+	doc["_id"] = id
+	doc["_rev"] = fmt.Sprintf("%d-%x", f.revisions, f.revisions)
+	db[id] = doc
+	return http.StatusCreated, map[string]interface{}{"ok": true, "id": id, "rev": doc["_rev"]}
+}
+
+func (f *fakeCouchDB) find(w http.ResponseWriter, r *http.Request, db map[string]map[string]interface{}) {
+	var req struct {
+		Selector map[string]interface{} `json:"selector"`
+		Limit    int                    `json:"limit"`
+		Bookmark string                 `json:"bookmark"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	ids := make([]string, 0)
+	for id, doc := range db {
+		if doc["_deleted"] != true && mangoMatch(doc, req.Selector) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	skip, _ := strconv.Atoi(req.Bookmark)
+	if skip > len(ids) {
+		skip = len(ids)
+	}
+	ids = ids[skip:]
+	if req.Limit > 0 && len(ids) > req.Limit {
+		ids = ids[:req.Limit]
+	}
+
+	docs := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		docs[i] = db[id]
+	}
+	f.reply(w, http.StatusOK, map[string]interface{}{"docs": docs, "bookmark": strconv.Itoa(skip + len(ids))})
+}
+
+func (f *fakeCouchDB) reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func mangoMatch(doc map[string]interface{}, selector map[string]interface{}) bool {
+	for field, condition := range selector {
+		switch field {
+		case "$and", "$or":
+			matchedAny := false
+			for _, sub := range condition.([]interface{}) {
+				matched := mangoMatch(doc, sub.(map[string]interface{}))
+				if field == "$and" && !matched {
+					return false
+				}
+				matchedAny = matchedAny || matched
+			}
+			if field == "$or" && !matchedAny {
+				return false
+			}
+			continue
+		case "$not":
+			if mangoMatch(doc, condition.(map[string]interface{})) {
+				return false
+			}
+			continue
+		}
+
+		value, exists := mangoField(doc, field)
+		operators, ok := condition.(map[string]interface{})
+		if !ok {
+			operators = map[string]interface{}{"$eq": condition}
+		}
+		for op, operand := range operators {
+			if op == "$exists" {
+				if exists != operand.(bool) {
+					return false
+				}
+				continue
+			}
+			if !exists || !mangoCompare(op, value, operand) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func mangoField(doc map[string]interface{}, field string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func mangoCompare(op string, value, operand interface{}) bool {
+	v, _ := value.(string)
+	o, _ := operand.(string)
+	switch op {
+	case "$eq":
+		return v == o
+	case "$ne":
+		return v != o
+	case "$gt":
+		return v > o
+	case "$gte":
+		return v >= o
+	case "$lt":
+		return v < o
+	case "$lte":
+		return v <= o
+	case "$regex":
+		matched, _ := regexp.MatchString(o, v)
+		return matched
+	case "$in":
+		for _, i := range operand.([]interface{}) {
+			if v == i {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCouchDBExistingDatabase(t *testing.T) {
+	_, srv := newFakeCouchDB("", "")
+	defer srv.Close()
+
+	s, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w, err := NewWallet("password", s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = w.Create("test", "value"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s, err = NewCouchDbStorage("test", WithCouchDBURL(srv.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w, err = NewWallet("password", s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var value string
+	if err = w.Read("test", &value); err != nil {
+		t.Fatal(err.Error())
+	}
+	if value != "value" {
+		t.Fatalf("Expected: %s, Actual: %s", "value", value)
+	}
+}
+
+func TestCouchDBAuthentication(t *testing.T) {
+	f, srv := newFakeCouchDB("admin", "secret")
+	defer srv.Close()
+
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL)); err == nil {
+		t.Fatal("Opened storage without credentials")
+	}
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL), WithBasicAuth("admin", "wrong")); err == nil {
+		t.Fatal("Opened storage with wrong credentials")
+	}
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL), WithBasicAuth("admin", "secret")); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, opts := range [][]CouchDBOption{
+		{WithCouchDBURL(srv.URL), WithCookieAuth("admin", "secret")},
+		{WithCouchDBURL(srv.URL), WithCookieAuth("admin", "secret"), WithHTTPClient(&http.Client{})},
+	} {
+		s, err := NewCouchDbStorage("test", opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		w, err := NewWallet("password", s)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		f.expireSessions()
+		if err = w.Create("test", "value"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err = w.Delete("test"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func TestCouchDBReusesConnections(t *testing.T) {
+	f, srv := newFakeCouchDB("", "")
+	defer srv.Close()
+
+	s, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	w, err := NewWallet("password", s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		if err = w.Create(fmt.Sprintf("test%d", i), "value"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connections != 1 {
+		t.Fatalf("Expected: %d, Actual: %d", 1, f.connections)
+	}
+}
+
+func TestCouchDBTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(&fakeCouchDB{
+		dbs:      make(map[string]map[string]map[string]interface{}),
+		sessions: make(map[string]bool),
+	})
+	defer srv.Close()
+
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL)); err == nil {
+		t.Fatal("Accepted an untrusted certificate")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL), WithTLSConfig(&tls.Config{RootCAs: roots})); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestCouchDBLeavesSharedClientUnchanged(t *testing.T) {
+	srv := httptest.NewTLSServer(&fakeCouchDB{
+		dbs:      make(map[string]map[string]map[string]interface{}),
+		sessions: make(map[string]bool),
+	})
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL), WithHTTPClient(client), WithTLSConfig(&tls.Config{RootCAs: roots}), WithRequestTimeout(time.Second)); err != nil {
+		t.Fatal(err.Error())
+	}
+	// The transport may set up HTTP/2 in its TLS configuration when cloned
+	if client.Timeout != 0 || client.Transport != transport || transport.TLSClientConfig != nil && transport.TLSClientConfig.RootCAs != nil {
+		t.Fatal("The shared client was changed")
+	}
+
+	defaultClient := &http.Client{}
+	if _, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL), WithHTTPClient(defaultClient), WithTLSConfig(&tls.Config{RootCAs: roots})); err != nil {
+		t.Fatal(err.Error())
+	}
+	if config := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultClient.Transport != nil || config != nil && config.RootCAs != nil {
+		t.Fatal("The shared client or the default transport was changed")
+	}
+}
+
+func TestCouchDBReservedIDs(t *testing.T) {
+	_, srv := newFakeCouchDB("", "")
+	defer srv.Close()
+
+	s, err := NewCouchDbStorage("test", WithCouchDBURL(srv.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx := context.Background()
+
+	// Item ids may start with the '_' CouchDB reserves, or with the escape
+	ids := []string{"_a", "b", "~c", "~~d"}
+	for _, id := range ids {
+		if err = s.Create(ctx, Item{ID: id, Type: "test", Value: id}); err != nil {
+			t.Fatal(err.Error())
+		}
+		item, err := s.Read(ctx, id)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if item.ID != id || item.Value != id {
+			t.Fatalf("Expected: %s, Actual: %+v", id, item)
+		}
+		item.Value = "updated"
+		if err = s.Update(ctx, item); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	listed := make([]string, 0)
+	cursor := ""
+	for {
+		items, next, err := s.List(ctx, "test", cursor, 1)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, i := range items {
+			listed = append(listed, i.ID)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(listed)
+	if !reflect.DeepEqual(listed, ids) {
+		t.Fatalf("Expected: %s, Actual: %s", ids, listed)
+	}
+
+	items, err := s.Search(ctx, "test", StorageQuery{Op: QueryAnd})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found := make([]string, 0)
+	for _, i := range items {
+		found = append(found, i.ID)
+	}
+	sort.Strings(found)
+	if !reflect.DeepEqual(found, ids) {
+		t.Fatalf("Expected: %s, Actual: %s", ids, found)
+	}
+
+	err = s.(BatchStorage).Batch(ctx, []BatchOperation{
+		{Op: BatchCreate, Item: Item{ID: "_e", Type: "test"}},
+		{Op: BatchDelete, Item: Item{ID: "_a"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = s.Read(ctx, "_e"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = s.Delete(ctx, "_a"); err != ErrorNotFound {
+		t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+	}
+	if err = s.Delete(ctx, "~c"); err != nil {
+		t.Fatal(err.Error())
+	}
+}
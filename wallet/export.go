@@ -0,0 +1,416 @@
+package wallet
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"os"
+	"time"
+)
+
+// An export is laid out like an Indy wallet export:
+//
+//	header length   uint32, little endian
+//	header          exportHeader as JSON
+//	stream          ChaCha20-Poly1305 encrypted chunks
+//
+// The stream is split into chunks of ChunkSize bytes, each sealed on its own
+// with the header nonce incremented once per chunk. It holds the SHA-256 of
+// the header, then every record as a little endian uint32 length followed by
+// an exportRecord as JSON, and ends with a zero length. Indy encodes the
+// header and records with MessagePack, so the two formats are not
+// interchangeable.
+const (
+	exportVersion   = 1
+	exportChunkSize = 1024
+
+	// Bounds of the header, which is only authenticated once the key is
+	// derived from it.
+	maxExportHeaderSize = 64 * 1024
+	maxExportChunkSize  = 1024 * 1024
+)
+
+var ErrorInvalidExport = errors.New("invalid or truncated export")
+
+type exportHeader struct {
+	Version       uint32    `json:"version"`
+	KeyDerivation kdfParams `json:"keyDerivation"`
+	Nonce         []byte    `json:"nonce"`
+	ChunkSize     int       `json:"chunkSize"`
+	Time          int64     `json:"time"`
+}
+
+type exportRecord struct {
+	Type  string          `json:"type,omitempty"`
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value"`
+	Tags  Tags            `json:"tags,omitempty"`
+}
+
+// Export writes every record of the wallet, including its keys and master
+// seed, to a new file at path, encrypted under a key derived from exportKey
+// with Argon2id. Keys whose policy is NonExportable are left out, and so is
+// the audit log, which belongs to the wallet it records.
+func (w *wallet) Export(path string, exportKey string) (err error) {
+	if err = w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	return w.export(f, exportKey)
+}
+
+func (w *wallet) export(out io.Writer, exportKey string) error {
+	params, err := newKDFParams(KeyDerivationArgon2id)
+	if err != nil {
+		return err
+	}
+	key, err := params.deriveKey(exportKey)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	h := exportHeader{
+		Version:       exportVersion,
+		KeyDerivation: params,
+		Nonce:         make([]byte, chacha20poly1305.NonceSize),
+		ChunkSize:     exportChunkSize,
+		Time:          time.Now().Unix(),
+	}
+	if _, err = rand.Read(h.Nonce); err != nil {
+		return err
+	}
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(out)
+	if err = binary.Write(bw, binary.LittleEndian, uint32(len(header))); err != nil {
+		return err
+	}
+	if _, err = bw.Write(header); err != nil {
+		return err
+	}
+
+	s, err := newExportStream(key, h.Nonce, h.ChunkSize)
+	if err != nil {
+		return err
+	}
+	s.w = bw
+
+	hash := sha256.Sum256(header)
+	if err = s.write(hash[:]); err != nil {
+		return err
+	}
+
+	cursor := ""
+	for {
+		items, next, err := w.storage.List(w.ctx, "", cursor, defaultPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range items {
+			if i.ID == metadataId {
+				continue
+			}
+			r, err := w.decryptRecord(i)
+			if err != nil {
+				return err
+			}
+			if isAuditRecord(r.ID) {
+				continue
+			}
+			if r.Type == keyRecordType {
+				var key keyRecord
+				err = json.Unmarshal(r.Value, &key)
+				key.zero()
+				if err != nil {
+					zero(r.Value)
+					return err
+				}
+				if key.Policy != nil && key.Policy.NonExportable {
+					zero(r.Value)
+					continue
+				}
+			}
+			err = s.writeRecord(&exportRecord{Type: r.Type, ID: r.ID, Value: r.Value, Tags: r.Tags})
+			zero(r.Value)
+			if err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if err = s.writeRecord(nil); err != nil {
+		return err
+	}
+	if err = s.close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Import adds the records of an export written by Export, re-encrypting them
+// under the wallet's own keys. It fails with ErrorAlreadyExists, and imports
+// nothing, if the wallet already has a record with the id of an exported
+// one.
+func (w *wallet) Import(path string, exportKey string) error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := &Batch{w: w, metadata: w.metadata}
+	if err = w.importRecords(bufio.NewReader(f), exportKey, b); err != nil {
+		return err
+	}
+	return b.commit()
+}
+
+func (w *wallet) importRecords(in io.Reader, exportKey string, b *Batch) error {
+	var length uint32
+	if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+		return ErrorInvalidExport
+	}
+	if length > maxExportHeaderSize {
+		return ErrorInvalidExport
+	}
+	header := make([]byte, length)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return ErrorInvalidExport
+	}
+
+	var h exportHeader
+	if err := json.Unmarshal(header, &h); err != nil {
+		return ErrorInvalidExport
+	}
+	if h.Version != exportVersion {
+		return errors.New("unsupported export version")
+	}
+	if h.ChunkSize <= 0 || h.ChunkSize > maxExportChunkSize {
+		return ErrorInvalidExport
+	}
+	if err := h.KeyDerivation.validate(); err != nil {
+		return ErrorInvalidExport
+	}
+
+	key, err := h.KeyDerivation.deriveKey(exportKey)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+	s, err := newExportStream(key, h.Nonce, h.ChunkSize)
+	if err != nil {
+		return ErrorInvalidExport
+	}
+	s.r = in
+
+	// The first chunk only opens with the right key
+	hash := make([]byte, sha256.Size)
+	if err = s.read(hash); err == errorChunk {
+		return ErrorInvalidPassword
+	} else if err != nil {
+		return ErrorInvalidExport
+	}
+	expected := sha256.Sum256(header)
+	if subtle.ConstantTimeCompare(hash, expected[:]) != 1 {
+		return ErrorInvalidExport
+	}
+
+	for {
+		r, err := s.readRecord()
+		if err != nil {
+			return ErrorInvalidExport
+		}
+		if r == nil {
+			return nil
+		}
+		if isAuditRecord(r.ID) {
+			continue
+		}
+
+		opts := []RecordOption{WithType(r.Type)}
+		if r.Tags != nil {
+			opts = append(opts, WithTags(r.Tags))
+		}
+		if err = b.create(r.ID, r.Value, opts); err != nil {
+			return err
+		}
+	}
+}
+
+var errorChunk = errors.New("chunk cannot be decrypted")
+
+// exportStream encrypts or decrypts the chunked stream of an export.
+type exportStream struct {
+	aead      cipher.AEAD
+	nonce     []byte
+	chunkSize int
+	buf       []byte
+
+	w io.Writer
+	r io.Reader
+}
+
+func newExportStream(key []byte, nonce []byte, chunkSize int) (*exportStream, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != chacha20poly1305.NonceSize {
+		return nil, errors.New("invalid nonce")
+	}
+	return &exportStream{
+		aead:      aead,
+		nonce:     append([]byte(nil), nonce...),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// next increments the nonce as a little endian number, like libsodium's
+// sodium_increment.
+func (s *exportStream) next() {
+	for i := range s.nonce {
+		s.nonce[i]++
+		if s.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// write buffers p until a chunk is full. The buffer is reused and wiped
+// once flushed, as it holds the plaintext of the records.
+func (s *exportStream) write(p []byte) error {
+	if s.buf == nil {
+		s.buf = make([]byte, 0, s.chunkSize)
+	}
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):s.chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		if len(s.buf) == s.chunkSize {
+			err := s.flush(s.buf)
+			zero(s.buf)
+			s.buf = s.buf[:0]
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *exportStream) flush(chunk []byte) error {
+	_, err := s.w.Write(s.aead.Seal(nil, s.nonce, chunk, nil))
+	s.next()
+	return err
+}
+
+func (s *exportStream) close() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	err := s.flush(s.buf)
+	zero(s.buf)
+	s.buf = nil
+	return err
+}
+
+// writeRecord writes r, or the end of the records if r is nil.
+func (s *exportStream) writeRecord(r *exportRecord) error {
+	var data []byte
+	if r != nil {
+		var err error
+		if data, err = json.Marshal(r); err != nil {
+			return err
+		}
+		defer zero(data)
+	}
+
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(data)))
+	if err := s.write(length); err != nil {
+		return err
+	}
+	return s.write(data)
+}
+
+// read fills p, decrypting chunks as needed.
+func (s *exportStream) read(p []byte) error {
+	for len(s.buf) < len(p) {
+		chunk := make([]byte, s.chunkSize+s.aead.Overhead())
+		n, err := io.ReadFull(s.r, chunk)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		plaintext, err := s.aead.Open(nil, s.nonce, chunk[:n], nil)
+		if err != nil {
+			return errorChunk
+		}
+		s.next()
+		s.buf = append(s.buf, plaintext...)
+	}
+
+	copy(p, s.buf)
+	s.buf = s.buf[len(p):]
+	return nil
+}
+
+// readRecord returns the next record, or nil at the end of the records.
+func (s *exportStream) readRecord() (*exportRecord, error) {
+	length := make([]byte, 4)
+	if err := s.read(length); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(length)
+	if n == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, n)
+	if err := s.read(data); err != nil {
+		return nil, err
+	}
+	var r exportRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -0,0 +1,89 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type fileWrapper struct {
+	key []byte
+}
+
+// NewFileWrapper returns a software Wrapper that wraps secrets with a key
+// kept in the file at path, generating the key if the file does not exist.
+// It is a reference implementation: the key is only protected by the file
+// permissions, so production deployments should use an HSM backed Wrapper.
+func NewFileWrapper(path string) (Wrapper, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateFileWrapper(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errors.New("invalid wrapping key")
+	}
+	return &fileWrapper{key: key}, nil
+}
+
+func generateFileWrapper(path string) (Wrapper, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return &fileWrapper{key: key}, nil
+}
+
+func (f *fileWrapper) Wrap(secret []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(f.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(secret)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+func (f *fileWrapper) Unwrap(wrappedSecret []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(f.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedSecret) < chacha20poly1305.NonceSizeX+aead.Overhead() {
+		return nil, errors.New("invalid wrapped secret")
+	}
+
+	return aead.Open(nil, wrappedSecret[:chacha20poly1305.NonceSizeX], wrappedSecret[chacha20poly1305.NonceSizeX:], nil)
+}
@@ -0,0 +1,248 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	masterSeedId         = "_local/seed/master"
+	masterSeedRecordType = "_local/seed"
+
+	// legacyMasterSeedId is where wallets used to keep the master seed,
+	// among the keys. readMasterSeed moves it to masterSeedId.
+	legacyMasterSeedId = "_local/masterseed"
+
+	// derivationPath is the SLIP-0010 path of the n-th key created by
+	// CreateKey once the wallet has a master seed.
+	derivationPath = "m/0'/%d'"
+
+	hardenedOffset = 0x80000000
+)
+
+// masterSeed is the record holding the wallet's master seed and the index of
+// the next key to derive from it.
+type masterSeed struct {
+	Seed      []byte `json:"seed"`
+	NextIndex uint32 `json:"nextIndex"`
+}
+
+// SetMasterSeed stores the seed, e.g. a BIP-39 seed from MnemonicToSeed, from
+// which CreateKey derives Ed25519 keys along hardened SLIP-0010 paths. The
+// master seed cannot be replaced once set.
+func (w *wallet) SetMasterSeed(seed []byte) error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	if len(seed) < 16 || len(seed) > 64 {
+		return errors.New("seed must be between 16 and 64 bytes")
+	}
+	if _, err := w.readMasterSeed(); err != ErrorNotFound {
+		if err == nil {
+			return errors.New("master seed already set")
+		}
+		return err
+	}
+
+	return w.create(masterSeedId, masterSeed{Seed: seed}, WithType(masterSeedRecordType))
+}
+
+// DeriveKey derives the Ed25519 key at a hardened SLIP-0010 path such as
+// "m/0'/1'" from the master seed and stores it.
+func (w *wallet) DeriveKey(typ KeyType, path string) (string, error) {
+	if err := w.rlock(); err != nil {
+		return "", err
+	}
+	defer w.mu.RUnlock()
+
+	ms, err := w.readMasterSeed()
+	if err != nil {
+		return "", err
+	}
+	return w.deriveKey(typ, ms.Seed, path, keyOptions{})
+}
+
+// RestoreDerivedKeys derives the first count keys that CreateKey derives from
+// the master seed, for instance after restoring a wallet from its mnemonic,
+// and returns their ids. CreateKey continues after the restored keys.
+func (w *wallet) RestoreDerivedKeys(count uint32) ([]string, error) {
+	if err := w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	ms, err := w.readMasterSeed()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		id, err := w.deriveKey(Ed25519VerificationKey2018Type, ms.Seed, fmt.Sprintf(derivationPath, i), keyOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if ms.NextIndex < count {
+		ms.NextIndex = count
+		if err = w.update(masterSeedId, ms); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// createDerivedKey derives the next key from the master seed, or fails with
+// ErrorNotFound if the wallet has none. The index of the key is reserved
+// before the key is stored, so that concurrent calls derive distinct keys,
+// and skipped if it holds a key already, such as one created by DeriveKey.
+func (w *wallet) createDerivedKey(o keyOptions) (id string, err error) {
+	defer func() {
+		if err != ErrorNotFound {
+			w.audit(AuditCreateKey, id, &err)
+		}
+	}()
+
+	for {
+		ms, revision, err := w.readMasterSeedRevision()
+		if err != nil {
+			return "", err
+		}
+
+		index := ms.NextIndex
+		ms.NextIndex++
+		if err = w.update(masterSeedId, ms, WithRevision(revision)); err == ErrorConflict {
+			zero(ms.Seed)
+			continue
+		} else if err != nil {
+			zero(ms.Seed)
+			return "", err
+		}
+
+		id, key, err := deriveKeyRecord(Ed25519VerificationKey2018Type, ms.Seed, fmt.Sprintf(derivationPath, index))
+		zero(ms.Seed)
+		if err != nil {
+			return "", err
+		}
+		if err = w.storeNewKey(id, key, o); err != ErrorAlreadyExists {
+			return id, err
+		}
+	}
+}
+
+func (w *wallet) deriveKey(typ KeyType, seed []byte, path string, o keyOptions) (string, error) {
+	id, key, err := deriveKeyRecord(typ, seed, path)
+	if err != nil {
+		return "", err
+	}
+
+	return w.storeKey(id, key, o)
+}
+
+func deriveKeyRecord(typ KeyType, seed []byte, path string) (string, *keyRecord, error) {
+	if typ != Ed25519VerificationKey2018Type {
+		return "", nil, ErrorInvalidKeyType
+	}
+
+	sk, err := slip10DeriveEd25519(seed, path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, key, err := keyFromSeed(typ, sk)
+	zero(sk)
+	if err != nil {
+		return "", nil, err
+	}
+	key.Path = path
+	return id, key, nil
+}
+
+func (w *wallet) readMasterSeed() (*masterSeed, error) {
+	ms, _, err := w.readMasterSeedRevision()
+	return ms, err
+}
+
+// readMasterSeedRevision reads the master seed and its revision, moving it
+// from legacyMasterSeedId first if needed.
+func (w *wallet) readMasterSeedRevision() (*masterSeed, string, error) {
+	var ms masterSeed
+	revision, err := w.readRevision(masterSeedId, &ms)
+	if err != ErrorNotFound {
+		if err != nil {
+			return nil, "", err
+		}
+		return &ms, revision, nil
+	}
+
+	r, err := w.decryptStoredRecord(legacyMasterSeedId)
+	if err != nil {
+		return nil, "", err
+	}
+	defer zero(r.Value)
+	if err = json.Unmarshal(r.Value, &ms); err != nil {
+		return nil, "", err
+	}
+	defer zero(ms.Seed)
+	if err = w.create(masterSeedId, ms, WithType(masterSeedRecordType)); err != nil && err != ErrorAlreadyExists {
+		return nil, "", err
+	}
+	if err = w.delete(legacyMasterSeedId); err != nil && err != ErrorNotFound {
+		return nil, "", err
+	}
+	return w.readMasterSeedRevision()
+}
+
+// slip10DeriveEd25519 derives the Ed25519 private key at path from seed as
+// specified by SLIP-0010. Ed25519 only supports hardened derivation.
+func slip10DeriveEd25519(seed []byte, path string) ([]byte, error) {
+	indexes, err := parseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, chainCode := slip10MasterKey(Ed25519VerificationKey2018Type, slip10Curves[Ed25519VerificationKey2018Type], seed)
+	for _, index := range indexes {
+		data := make([]byte, 0, 37)
+		data = append(data, 0)
+		data = append(data, key...)
+		data = append(data, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(data[33:], index)
+
+		mac := hmac.New(sha512.New, chainCode)
+		mac.Write(data)
+		i := mac.Sum(nil)
+		key, chainCode = i[:32], i[32:]
+	}
+	return key, nil
+}
+
+func parseDerivationPath(path string) ([]uint32, error) {
+	segments := strings.Split(path, "/")
+	if segments[0] != "m" {
+		return nil, errors.New("derivation path must start with m")
+	}
+
+	indexes := make([]uint32, 0, len(segments)-1)
+	for _, s := range segments[1:] {
+		if !strings.HasSuffix(s, "'") && !strings.HasSuffix(s, "h") {
+			return nil, fmt.Errorf("derivation path segment %s is not hardened", s)
+		}
+		i, err := strconv.ParseUint(s[:len(s)-1], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid derivation path segment %s", s)
+		}
+		indexes = append(indexes, uint32(i)+hardenedOffset)
+	}
+	return indexes, nil
+}
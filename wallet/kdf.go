@@ -0,0 +1,139 @@
+package wallet
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyDerivation is the method used to derive the master key, which encrypts
+// the wallet metadata, from the wallet password.
+type KeyDerivation string
+
+const (
+	// KeyDerivationArgon2id derives the master key with Argon2id. This is the
+	// default for new wallets.
+	KeyDerivationArgon2id KeyDerivation = "argon2id"
+	// KeyDerivationPBKDF2 derives the master key with PBKDF2-HMAC-SHA512.
+	KeyDerivationPBKDF2 KeyDerivation = "pbkdf2-sha512"
+	// KeyDerivationRaw uses the password, a base58 encoded 32 byte key such as
+	// one returned by GenerateRawKey, as the master key.
+	KeyDerivationRaw KeyDerivation = "raw"
+)
+
+const (
+	saltSize = 16
+
+	pbkdf2Iterations = 100000
+)
+
+// Argon2id parameters for new wallets, as recommended by RFC 9106 for
+// memory constrained environments.
+var (
+	argon2Time    uint32 = 3
+	argon2Memory  uint32 = 64 * 1024
+	argon2Threads uint8  = 4
+)
+
+// legacySalt is the salt of wallets created before the salt was generated
+// per wallet.
+const legacySalt = "saltsaltsaltsalt"
+
+// kdfParams are the key derivation parameters of a wallet. They are stored
+// in plaintext next to the encrypted metadata.
+type kdfParams struct {
+	Method     KeyDerivation `json:"method"`
+	Salt       []byte        `json:"salt,omitempty"`
+	Iterations uint32        `json:"iterations,omitempty"`
+	Memory     uint32        `json:"memory,omitempty"`
+	Threads    uint8         `json:"threads,omitempty"`
+}
+
+func newKDFParams(method KeyDerivation) (kdfParams, error) {
+	p := kdfParams{Method: method}
+	switch method {
+	case KeyDerivationArgon2id:
+		p.Iterations = argon2Time
+		p.Memory = argon2Memory
+		p.Threads = argon2Threads
+	case KeyDerivationPBKDF2:
+		p.Iterations = pbkdf2Iterations
+	case KeyDerivationRaw:
+		return p, nil
+	default:
+		return kdfParams{}, errors.New("unsupported key derivation method")
+	}
+
+	p.Salt = make([]byte, saltSize)
+	if _, err := rand.Read(p.Salt); err != nil {
+		return kdfParams{}, err
+	}
+	return p, nil
+}
+
+// Bounds of stored key derivation parameters, which are not authenticated:
+// beyond them, deriving the key could exhaust memory or take forever.
+const (
+	maxArgon2Time       = 100
+	maxArgon2Memory     = 4 * 1024 * 1024
+	maxPBKDF2Iterations = 10000000
+)
+
+var errorInvalidKDFParams = errors.New("invalid key derivation parameters")
+
+// validate checks parameters read from storage or an export file before
+// they are used.
+func (p kdfParams) validate() error {
+	switch p.Method {
+	case KeyDerivationArgon2id:
+		if p.Iterations < 1 || p.Iterations > maxArgon2Time || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory {
+			return errorInvalidKDFParams
+		}
+	case KeyDerivationPBKDF2:
+		if p.Iterations < 1 || p.Iterations > maxPBKDF2Iterations {
+			return errorInvalidKDFParams
+		}
+	case KeyDerivationRaw:
+	default:
+		return errors.New("unsupported key derivation method")
+	}
+	return nil
+}
+
+func legacyKDFParams() kdfParams {
+	return kdfParams{
+		Method:     KeyDerivationPBKDF2,
+		Salt:       []byte(legacySalt),
+		Iterations: pbkdf2Iterations,
+	}
+}
+
+func (p kdfParams) deriveKey(password string) ([]byte, error) {
+	switch p.Method {
+	case KeyDerivationArgon2id:
+		return argon2.IDKey([]byte(password), p.Salt, p.Iterations, p.Memory, p.Threads, chacha20poly1305.KeySize), nil
+	case KeyDerivationPBKDF2:
+		return pbkdf2.Key([]byte(password), p.Salt, int(p.Iterations), chacha20poly1305.KeySize, crypto.SHA512.New), nil
+	case KeyDerivationRaw:
+		key := base58.Decode(password)
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, errors.New("raw key must be a base58 encoded 32 byte key")
+		}
+		return key, nil
+	}
+	return nil, errors.New("unsupported key derivation method")
+}
+
+// GenerateRawKey returns a random base58 encoded key for use as the password
+// of a wallet created with KeyDerivationRaw.
+func GenerateRawKey() (string, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base58.Encode(key), nil
+}
@@ -0,0 +1,157 @@
+package wallet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// keyCache keeps up to size recently used keys decrypted in memory for at
+// most ttl, so that signing and opening messages does not read and decrypt
+// the key from storage every time. A nil keyCache caches nothing.
+//
+// Keys are wiped when they leave the cache, or once they are released if an
+// operation still holds them then.
+type keyCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+
+	// held has the entry of every key in the cache or still held.
+	held map[*keyRecord]*keyCacheEntry
+}
+
+type keyCacheEntry struct {
+	id      string
+	key     *keyRecord
+	expires time.Time
+
+	// refs counts the operations holding the key.
+	refs    int
+	dropped bool
+}
+
+func newKeyCache(size int, ttl time.Duration) *keyCache {
+	if size <= 0 {
+		return nil
+	}
+	return &keyCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+		held:    make(map[*keyRecord]*keyCacheEntry),
+	}
+}
+
+// get returns the cached key id, which must be released with release.
+func (c *keyCache) get(id string) *keyRecord {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*keyCacheEntry)
+	if c.ttl > 0 && c.now().After(entry.expires) {
+		c.drop(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	entry.refs++
+	return entry.key
+}
+
+// put adds a key, along with its Curve25519 private key if it has one, held
+// by the caller, which must release it. The key must not be modified
+// afterwards.
+func (c *keyCache) put(id string, key *keyRecord) {
+	if c == nil {
+		return
+	}
+	key.curve25519PrivateKey()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.drop(e)
+	}
+	entry := &keyCacheEntry{id: id, key: key, expires: c.now().Add(c.ttl), refs: 1}
+	c.entries[id] = c.lru.PushFront(entry)
+	c.held[key] = entry
+	for c.lru.Len() > c.size {
+		c.drop(c.lru.Back())
+	}
+}
+
+// release ends the use of a key returned by get or passed to put, and wipes
+// it if it left the cache in the meantime. It returns false if the key is
+// not from the cache.
+func (c *keyCache) release(key *keyRecord) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.held[key]
+	if !ok {
+		return false
+	}
+	entry.refs--
+	if entry.dropped && entry.refs == 0 {
+		key.zero()
+		delete(c.held, key)
+	}
+	return true
+}
+
+// drop removes an entry, wiping its key unless it is held. It must be called
+// with mu held.
+func (c *keyCache) drop(e *list.Element) {
+	entry := e.Value.(*keyCacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.id)
+	entry.dropped = true
+	if entry.refs == 0 {
+		entry.key.zero()
+		delete(c.held, entry.key)
+	}
+}
+
+// clear removes and wipes every key. The keys must no longer be in use.
+func (c *keyCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.held {
+		key.zero()
+	}
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.held = make(map[*keyRecord]*keyCacheEntry)
+}
+
+func (c *keyCache) remove(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[id]; ok {
+		c.drop(e)
+	}
+}
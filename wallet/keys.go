@@ -1,12 +1,355 @@
 package wallet
 
-import "crypto"
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/teserakt-io/golang-ed25519/extra25519"
+	"golang.org/x/crypto/curve25519"
+	"math/big"
+	"time"
+)
 
 type KeyType string
 
-const Ed25519VerificationKey2018Type KeyType = "Ed25519VerificationKey2018"
+const (
+	Ed25519VerificationKey2018Type        KeyType = "Ed25519VerificationKey2018"
+	X25519KeyAgreementKey2019Type         KeyType = "X25519KeyAgreementKey2019"
+	EcdsaSecp256k1VerificationKey2019Type KeyType = "EcdsaSecp256k1VerificationKey2019"
+	EcdsaSecp256r1VerificationKey2019Type KeyType = "EcdsaSecp256r1VerificationKey2019"
+	XChaCha20Poly1305KeyType              KeyType = "XChaCha20Poly1305"
+)
+
+var ErrorInvalidKeyType = errors.New("invalid key type")
 
 type Key interface {
 	Sign(id string, data []byte) (signature []byte, err error)
 	Verify(crypto.PublicKey, []byte) (signature []byte, err error)
 }
+
+// KeyCreator creates keys, either directly in a wallet or as part of a
+// Batch.
+type KeyCreator interface {
+	CreateKey(typ KeyType, opts ...KeyOption) (string, error)
+}
+
+// keyRecordType is the record type of the keys stored under "_local/".
+const keyRecordType = "_local/key"
+
+// KeyInfo describes a key held by the wallet, without its private material.
+type KeyInfo struct {
+	ID   string
+	Type KeyType
+	// Path is the SLIP-0010 derivation path of keys derived from the
+	// master seed.
+	Path string
+
+	DID     string
+	Purpose string
+	Tags    Tags
+
+	// Created is zero for keys created before it was recorded.
+	Created time.Time
+
+	// Rotated is when RotateKey retired the key in favour of ReplacedBy.
+	Rotated    time.Time
+	ReplacedBy string
+	Replaces   string
+
+	// Policy restricts the use of the key if it is set. Uses counts its
+	// uses if the policy limits them.
+	Policy *KeyPolicy
+	Uses   uint64
+}
+
+// Retired reports whether the key was replaced by RotateKey. Retired keys
+// still decrypt and verify, but no longer sign or encrypt.
+func (k KeyInfo) Retired() bool {
+	return k.ReplacedBy != ""
+}
+
+// keyRecord is the value stored under "_local/<id>" for every key held by
+// the wallet. Key holds the Ed25519 private key, or the private scalar of
+// the other asymmetric key types, or the symmetric key itself.
+type keyRecord struct {
+	Type KeyType `json:"type"`
+	Key  []byte  `json:"key"`
+	Path string  `json:"path,omitempty"`
+
+	DID     string `json:"did,omitempty"`
+	Purpose string `json:"purpose,omitempty"`
+	Tags    Tags   `json:"tags,omitempty"`
+
+	// Created and Rotated are Unix times.
+	Created    int64  `json:"created,omitempty"`
+	Rotated    int64  `json:"rotated,omitempty"`
+	ReplacedBy string `json:"replacedBy,omitempty"`
+	Replaces   string `json:"replaces,omitempty"`
+
+	Policy *KeyPolicy `json:"policy,omitempty"`
+	Uses   uint64     `json:"uses,omitempty"`
+
+	// agreementKey is the Curve25519 private key, once computed.
+	agreementKey *[32]byte
+}
+
+// UnmarshalJSON also accepts the original format, in which an Ed25519
+// private key was stored on its own.
+func (k *keyRecord) UnmarshalJSON(b []byte) error {
+	var legacy []byte
+	if err := json.Unmarshal(b, &legacy); err == nil {
+		k.Type = Ed25519VerificationKey2018Type
+		k.Key = legacy
+		return nil
+	}
+
+	type plain keyRecord
+	return json.Unmarshal(b, (*plain)(k))
+}
+
+func (k *keyRecord) info(id string) KeyInfo {
+	info := KeyInfo{
+		ID:         id,
+		Type:       k.Type,
+		Path:       k.Path,
+		DID:        k.DID,
+		Purpose:    k.Purpose,
+		Tags:       k.Tags,
+		ReplacedBy: k.ReplacedBy,
+		Replaces:   k.Replaces,
+		Policy:     k.Policy,
+		Uses:       k.Uses,
+	}
+	if k.Created != 0 {
+		info.Created = time.Unix(k.Created, 0)
+	}
+	if k.Rotated != 0 {
+		info.Rotated = time.Unix(k.Rotated, 0)
+	}
+	return info
+}
+
+// generateKey creates a key of the given type from a random seed.
+func generateKey(typ KeyType) (string, *keyRecord, error) {
+	for {
+		seed := make([]byte, SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return "", nil, err
+		}
+
+		id, key, err := keyFromSeed(typ, seed)
+		zero(seed)
+		if err != errorInvalidSeed {
+			return id, key, err
+		}
+	}
+}
+
+// keyFromSeed derives a key of the given type from a 32 byte seed and returns
+// it with its id. Ed25519 keys are derived as in Hyperledger Indy, the seed
+// is the private scalar of X25519 and ECDSA keys and symmetric keys are the
+// seed itself. The id of an asymmetric key is its base58 encoded public key.
+func keyFromSeed(typ KeyType, seed []byte) (string, *keyRecord, error) {
+	if len(seed) != SeedSize {
+		return "", nil, errors.New("seed must be 32 bytes")
+	}
+
+	key := &keyRecord{Type: typ}
+	switch typ {
+	case Ed25519VerificationKey2018Type:
+		key.Key = ed25519.NewKeyFromSeed(seed)
+	case X25519KeyAgreementKey2019Type:
+		key.Key = append([]byte{}, seed...)
+	case EcdsaSecp256k1VerificationKey2019Type:
+		if !validScalar(btcec.S256(), seed) {
+			return "", nil, errorInvalidSeed
+		}
+		key.Key = append([]byte{}, seed...)
+	case EcdsaSecp256r1VerificationKey2019Type:
+		if !validScalar(elliptic.P256(), seed) {
+			return "", nil, errorInvalidSeed
+		}
+		key.Key = append([]byte{}, seed...)
+	case XChaCha20Poly1305KeyType:
+		key.Key = append([]byte{}, seed...)
+		h := sha256.Sum256(key.Key)
+		return base58.Encode(h[:16]), key, nil
+	default:
+		return "", nil, ErrorInvalidKeyType
+	}
+
+	pk, err := key.publicKey()
+	if err != nil {
+		return "", nil, err
+	}
+	return base58.Encode(pk), key, nil
+}
+
+// publicKey returns the encoded public key: 32 bytes for Ed25519 and X25519,
+// a 33 byte compressed point for the ECDSA key types.
+func (k *keyRecord) publicKey() ([]byte, error) {
+	switch k.Type {
+	case Ed25519VerificationKey2018Type:
+		return ed25519.PrivateKey(k.Key).Public().(ed25519.PublicKey), nil
+	case X25519KeyAgreementKey2019Type:
+		return curve25519.X25519(k.Key, curve25519.Basepoint)
+	case EcdsaSecp256k1VerificationKey2019Type:
+		_, pk := btcec.PrivKeyFromBytes(btcec.S256(), k.Key)
+		return pk.SerializeCompressed(), nil
+	case EcdsaSecp256r1VerificationKey2019Type:
+		x, y := elliptic.P256().ScalarBaseMult(k.Key)
+		return compressP256(x, y), nil
+	}
+	return nil, ErrorInvalidKeyType
+}
+
+func (k *keyRecord) sign(data []byte) ([]byte, error) {
+	switch k.Type {
+	case Ed25519VerificationKey2018Type:
+		return ed25519.Sign(k.Key, data), nil
+	case EcdsaSecp256k1VerificationKey2019Type:
+		sk, _ := btcec.PrivKeyFromBytes(btcec.S256(), k.Key)
+		hash := sha256.Sum256(data)
+		sig, err := sk.Sign(hash[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(padScalar(sig.R), padScalar(sig.S)...), nil
+	case EcdsaSecp256r1VerificationKey2019Type:
+		sk := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(k.Key)}
+		sk.Curve = elliptic.P256()
+		sk.X, sk.Y = sk.Curve.ScalarBaseMult(k.Key)
+		hash := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, sk, hash[:])
+		if err != nil {
+			return nil, err
+		}
+		return append(padScalar(r), padScalar(s)...), nil
+	}
+	return nil, ErrorInvalidKeyType
+}
+
+// verify checks a signature made by sign. ECDSA signatures are the 64 byte
+// concatenation of r and s over the SHA-256 digest of data, as in JWS.
+func verify(typ KeyType, publicKey []byte, data []byte, sig []byte) bool {
+	switch typ {
+	case Ed25519VerificationKey2018Type:
+		return len(publicKey) == ed25519.PublicKeySize && ed25519.Verify(publicKey, data, sig)
+	case EcdsaSecp256k1VerificationKey2019Type:
+		pk, err := btcec.ParsePubKey(publicKey, btcec.S256())
+		if err != nil || len(sig) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(data)
+		s := &btcec.Signature{R: new(big.Int).SetBytes(sig[:32]), S: new(big.Int).SetBytes(sig[32:])}
+		return s.Verify(hash[:], pk)
+	case EcdsaSecp256r1VerificationKey2019Type:
+		x, y, err := decompressP256(publicKey)
+		if err != nil || len(sig) != 64 {
+			return false
+		}
+		hash := sha256.Sum256(data)
+		pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		return ecdsa.Verify(pk, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+// curve25519PrivateKey returns the private key used for key agreement, which
+// for Ed25519 keys is the birationally equivalent Curve25519 key. It is kept
+// on k, so that it is computed once for cached keys and wiped with k.
+func (k *keyRecord) curve25519PrivateKey() (*[32]byte, error) {
+	if k.agreementKey != nil {
+		return k.agreementKey, nil
+	}
+
+	var sk [32]byte
+	switch k.Type {
+	case Ed25519VerificationKey2018Type:
+		ek := new([64]byte)
+		copy(ek[:], k.Key[:64])
+		extra25519.PrivateKeyToCurve25519(&sk, ek)
+		zero(ek[:])
+	case X25519KeyAgreementKey2019Type:
+		copy(sk[:], k.Key)
+	default:
+		return nil, ErrorInvalidKeyType
+	}
+	k.agreementKey = &sk
+	return &sk, nil
+}
+
+// curve25519PublicKey decodes a base58 public key of the given type for key
+// agreement, converting Ed25519 public keys to Curve25519.
+func curve25519PublicKey(typ KeyType, publicKey string) (*[32]byte, error) {
+	d := base58.Decode(publicKey)
+	if len(d) != 32 {
+		return nil, errors.New("invalid public key")
+	}
+
+	var pk [32]byte
+	switch typ {
+	case Ed25519VerificationKey2018Type:
+		edpk := new([32]byte)
+		copy(edpk[:], d)
+		if !extra25519.PublicKeyToCurve25519(&pk, edpk) {
+			return nil, errors.New("invalid public key")
+		}
+	case X25519KeyAgreementKey2019Type:
+		copy(pk[:], d)
+	default:
+		return nil, ErrorInvalidKeyType
+	}
+	return &pk, nil
+}
+
+func validScalar(curve elliptic.Curve, b []byte) bool {
+	d := new(big.Int).SetBytes(b)
+	return d.Sign() > 0 && d.Cmp(curve.Params().N) < 0
+}
+
+func padScalar(i *big.Int) []byte {
+	b := make([]byte, 32)
+	s := i.Bytes()
+	copy(b[32-len(s):], s)
+	return b
+}
+
+func compressP256(x, y *big.Int) []byte {
+	return append([]byte{2 + byte(y.Bit(0))}, padScalar(x)...)
+}
+
+func decompressP256(b []byte) (x, y *big.Int, err error) {
+	if len(b) != 33 || (b[0] != 2 && b[0] != 3) {
+		return nil, nil, errors.New("invalid public key")
+	}
+
+	params := elliptic.P256().Params()
+	x = new(big.Int).SetBytes(b[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil, nil, errors.New("invalid public key")
+	}
+
+	// y² = x³ - 3x + b
+	y = new(big.Int).Mul(x, x)
+	y.Mul(y, x)
+	threeX := new(big.Int).Lsh(x, 1)
+	threeX.Add(threeX, x)
+	y.Sub(y, threeX)
+	y.Add(y, params.B)
+	y.Mod(y, params.P)
+	if y.ModSqrt(y, params.P) == nil {
+		return nil, nil, errors.New("invalid public key")
+	}
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(params.P, y)
+	}
+	return x, y, nil
+}
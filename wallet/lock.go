@@ -0,0 +1,156 @@
+package wallet
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorLocked is returned by the operations of a locked wallet.
+var ErrorLocked = errors.New("wallet is locked")
+
+var errorClosed = errors.New("wallet is closed")
+
+// rlock holds the wallet's lock for reading, unless the wallet is locked, and
+// records the wallet as in use for auto-lock.
+func (w *wallet) rlock() error {
+	w.mu.RLock()
+	if w.metadata == nil {
+		w.mu.RUnlock()
+		return ErrorLocked
+	}
+	atomic.StoreInt64(&w.lastUsed, time.Now().UnixNano())
+	return nil
+}
+
+// Lock wipes the wallet's keys, and the private keys it has cached, from
+// memory. Until Unlock is called, operations fail with ErrorLocked, or
+// return false. Lock waits for operations in progress to finish.
+func (w *wallet) Lock() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lock()
+}
+
+func (s *walletState) lock() {
+	if s.metadata != nil {
+		s.metadata.zero()
+		s.metadata = nil
+	}
+	s.keys.clear()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// Unlock reads the wallet's keys from storage again after Lock, or after the
+// wallet was locked for being idle. The password is ignored for wallets
+// opened with NewWalletWithWrapper, whose keys are unwrapped by the wrapper.
+func (w *wallet) Unlock(password string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errorClosed
+	}
+
+	m, err := w.storage.Read(w.ctx, metadataId)
+	if err != nil {
+		return err
+	}
+
+	var metadata *metadata
+	params := w.kdf
+	if w.wrapper != nil {
+		metadata, err = unwrapMetadata(m, w.wrapper)
+	} else {
+		metadata, params, err = decryptMetadata(m, password)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The password is checked even when the wallet is unlocked
+	if w.metadata != nil {
+		metadata.zero()
+		return nil
+	}
+	w.metadata = metadata
+	w.kdf = params
+	w.startAutoLock()
+	return nil
+}
+
+// Close locks the wallet for good. The storage is left open, as it belongs
+// to the caller.
+func (w *wallet) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lock()
+	w.closed = true
+	return nil
+}
+
+// startAutoLock arms the auto-lock timer, if the wallet has one. It must be
+// called with mu held for writing, or before the wallet is shared.
+func (s *walletState) startAutoLock() {
+	if s.autoLock <= 0 {
+		return
+	}
+	atomic.StoreInt64(&s.lastUsed, time.Now().UnixNano())
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.autoLock, s.lockIfIdle)
+	} else {
+		s.timer.Reset(s.autoLock)
+	}
+}
+
+// lockIfIdle locks the wallet if it has not been used for the auto-lock
+// timeout, or checks again once it could have been.
+func (s *walletState) lockIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.metadata == nil {
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastUsed)))
+	if idle >= s.autoLock {
+		s.lock()
+		return
+	}
+	s.timer.Reset(s.autoLock - idle)
+}
+
+// zero overwrites b, so that secrets do not linger in memory after use.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func (m *metadata) zero() {
+	zero(m.TagNameKey)
+	zero(m.TagValueKey)
+	zero(m.HmacKey)
+	zero(m.TypeKey)
+	zero(m.NameKey)
+	zero(m.ItemKeyKey)
+	zero(m.PreviousItemKeyKey)
+}
+
+func (k *keyRecord) zero() {
+	zero(k.Key)
+	if k.agreementKey != nil {
+		zero(k.agreementKey[:])
+	}
+}
+
+// releaseKey wipes a key read by readKey once it is no longer needed, unless
+// it is kept in the key cache, which wipes it once it leaves the cache.
+func (w *wallet) releaseKey(key *keyRecord) {
+	if !w.keys.release(key) {
+		key.zero()
+	}
+}
@@ -0,0 +1,13 @@
+package wallet
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Keep key derivation cheap, tests open a lot of wallets
+	argon2Time, argon2Memory, argon2Threads = 1, 1024, 1
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,202 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrorInvalidProfileName is returned for profile names that are empty or
+// have characters other than letters, digits, '.', '_' and '-'.
+var ErrorInvalidProfileName = errors.New("invalid profile name")
+
+// profilePrefix starts the ids of the items of a profile. Item ids are
+// otherwise "metadata" or base64url ciphertexts, which have no '/'.
+const profilePrefix = "profile/"
+
+// Manager hosts many wallets, its profiles, in one storage. Each profile has
+// its own password, metadata and keys, and sees only its own items.
+type Manager struct {
+	storage Storage
+}
+
+// NewManager returns a manager for the profiles in s. The storage must not
+// also hold a wallet opened on it with NewWallet, which would take the
+// items of the profiles for its own.
+func NewManager(s Storage) *Manager {
+	return &Manager{storage: s}
+}
+
+// CreateProfile creates a profile protected by password, or fails with
+// ErrorAlreadyExists. The storage calls made while creating it use ctx.
+func (m *Manager) CreateProfile(ctx context.Context, name, password string, opts ...Option) (Wallet, error) {
+	s, err := m.profileStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewWallet(password, s, append(opts, WithOpenContext(ctx), withOpenMode(createOnly))...)
+}
+
+// OpenProfile opens an existing profile, or fails with ErrorNotFound. The
+// storage calls made while opening it use ctx.
+func (m *Manager) OpenProfile(ctx context.Context, name, password string, opts ...Option) (Wallet, error) {
+	s, err := m.profileStorage(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewWallet(password, s, append(opts, WithOpenContext(ctx), withOpenMode(openOnly))...)
+}
+
+// DeleteProfile deletes a profile and all its records and keys. Wallets
+// open on the profile must not be used afterwards. If it is interrupted,
+// the profile is still listed and can be deleted again.
+func (m *Manager) DeleteProfile(ctx context.Context, name string) error {
+	s, err := m.profileStorage(name)
+	if err != nil {
+		return err
+	}
+	if _, err = s.Read(ctx, metadataId); err != nil {
+		return err
+	}
+
+	// The metadata goes last, so that the profile is listed until then
+	for {
+		items, _, err := s.List(ctx, "", "", defaultPageSize)
+		if err != nil {
+			return err
+		}
+
+		deleted := 0
+		for _, i := range items {
+			if i.ID == metadataId {
+				continue
+			}
+			if err = s.Delete(ctx, i.ID); err != nil {
+				return err
+			}
+			deleted++
+		}
+		if deleted == 0 {
+			return s.Delete(ctx, metadataId)
+		}
+	}
+}
+
+// ListProfiles returns the names of the profiles in storage, in order.
+func (m *Manager) ListProfiles(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	cursor := profilePrefix
+	for {
+		items, _, err := m.storage.List(ctx, "", cursor, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) == 0 || !strings.HasPrefix(items[0].ID, profilePrefix) {
+			return names, nil
+		}
+
+		name := strings.TrimPrefix(items[0].ID, profilePrefix)
+		end := strings.Index(name, "/")
+		if end < 0 {
+			cursor = items[0].ID
+			continue
+		}
+		name = name[:end]
+		names = append(names, name)
+
+		// '0' follows '/', so this skips the other items of the profile
+		cursor = profilePrefix + name + "0"
+	}
+}
+
+func (m *Manager) profileStorage(name string) (*profileStorage, error) {
+	if name == "" {
+		return nil, ErrorInvalidProfileName
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return nil, ErrorInvalidProfileName
+		}
+	}
+	return &profileStorage{storage: m.storage, prefix: profilePrefix + name + "/"}, nil
+}
+
+// profileStorage is the part of a storage that holds the items of one
+// profile, whose ids all start with prefix.
+type profileStorage struct {
+	storage Storage
+	prefix  string
+}
+
+func (p *profileStorage) Create(ctx context.Context, item Item) error {
+	item.ID = p.prefix + item.ID
+	return p.storage.Create(ctx, item)
+}
+
+func (p *profileStorage) Read(ctx context.Context, id string) (Item, error) {
+	item, err := p.storage.Read(ctx, p.prefix+id)
+	item.ID = strings.TrimPrefix(item.ID, p.prefix)
+	return item, err
+}
+
+func (p *profileStorage) Update(ctx context.Context, item Item) error {
+	item.ID = p.prefix + item.ID
+	return p.storage.Update(ctx, item)
+}
+
+func (p *profileStorage) Delete(ctx context.Context, id string) error {
+	return p.storage.Delete(ctx, p.prefix+id)
+}
+
+func (p *profileStorage) Search(ctx context.Context, typ string, q StorageQuery) ([]Item, error) {
+	items, err := p.storage.Search(ctx, typ, q)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]Item, 0, len(items))
+	for _, i := range items {
+		if strings.HasPrefix(i.ID, p.prefix) {
+			i.ID = strings.TrimPrefix(i.ID, p.prefix)
+			found = append(found, i)
+		}
+	}
+	return found, nil
+}
+
+// List relies on items being ordered by id, so that those of the profile
+// follow its prefix.
+func (p *profileStorage) List(ctx context.Context, typ string, cursor string, limit int) ([]Item, string, error) {
+	items, next, err := p.storage.List(ctx, typ, p.prefix+cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for n, i := range items {
+		if !strings.HasPrefix(i.ID, p.prefix) {
+			return items[:n], "", nil
+		}
+		items[n].ID = strings.TrimPrefix(i.ID, p.prefix)
+	}
+	return items, strings.TrimPrefix(next, p.prefix), nil
+}
+
+// Batch applies ops atomically if the storage supports it.
+func (p *profileStorage) Batch(ctx context.Context, ops []BatchOperation) error {
+	bs, ok := p.storage.(BatchStorage)
+	if !ok {
+		return applyOperations(ctx, p, ops)
+	}
+
+	prefixed := make([]BatchOperation, len(ops))
+	for n, op := range ops {
+		op.Item.ID = p.prefix + op.Item.ID
+		prefixed[n] = op
+	}
+	return bs.Batch(ctx, prefixed)
+}
+
+// Close does nothing, the storage is shared with the other profiles.
+func (p *profileStorage) Close() error {
+	return nil
+}
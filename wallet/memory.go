@@ -1,33 +1,174 @@
 package wallet
 
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+)
+
 type inMemoryStorage struct {
-	items map[string]item
+	mu        sync.RWMutex
+	items     map[string]Item
+	revisions uint64
 }
 
+// NewInMemoryStorage creates a storage that keeps items in memory, for
+// tests and short-lived wallets. It is safe for concurrent use.
 func NewInMemoryStorage() Storage {
 	ims := &inMemoryStorage{}
-	ims.items = make(map[string]item)
+	ims.items = make(map[string]Item)
 	return ims
 }
 
-func (i *inMemoryStorage) create(item item) error {
-	i.items[item.ID] = item
-	return nil
+func (i *inMemoryStorage) Create(ctx context.Context, item Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.apply(BatchOperation{Op: BatchCreate, Item: item})
 }
 
-func (i *inMemoryStorage) read(id string) (item, error) {
+func (i *inMemoryStorage) Read(ctx context.Context, id string) (Item, error) {
+	if err := ctx.Err(); err != nil {
+		return Item{}, err
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 	if item, ok := i.items[id]; ok {
 		return item, nil
 	}
-	return item{}, ErrorNotFound
+	return Item{}, ErrorNotFound
 }
 
-func (i *inMemoryStorage) update(item item) error {
-	i.items[item.ID] = item
+func (i *inMemoryStorage) Update(ctx context.Context, item Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.apply(BatchOperation{Op: BatchUpdate, Item: item})
+}
+
+func (i *inMemoryStorage) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.apply(BatchOperation{Op: BatchDelete, Item: Item{ID: id}})
+}
+
+func (i *inMemoryStorage) Search(ctx context.Context, typ string, q StorageQuery) ([]Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	items := make([]Item, 0)
+	for _, item := range i.items {
+		if item.Type == typ && q.Match(item.Tags) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (i *inMemoryStorage) List(ctx context.Context, typ string, cursor string, limit int) ([]Item, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	ids := make([]string, 0)
+	for id, item := range i.items {
+		if id > cursor && (typ == "" || item.Type == typ) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
+	}
+
+	items := make([]Item, len(ids))
+	for n, id := range ids {
+		items[n] = i.items[id]
+	}
+	return items, next, nil
+}
+
+// Batch applies ops atomically: they are applied under the storage's lock,
+// and the items they changed are restored if one fails.
+func (i *inMemoryStorage) Batch(ctx context.Context, ops []BatchOperation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	previous := make(map[string]*Item)
+	for _, op := range ops {
+		if _, ok := previous[op.Item.ID]; !ok {
+			previous[op.Item.ID] = nil
+			if current, ok := i.items[op.Item.ID]; ok {
+				previous[op.Item.ID] = &current
+			}
+		}
+		if err := i.apply(op); err != nil {
+			for id, item := range previous {
+				if item == nil {
+					delete(i.items, id)
+				} else {
+					i.items[id] = *item
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// apply makes the change of op. The caller must hold the lock.
+func (i *inMemoryStorage) apply(op BatchOperation) error {
+	current, ok := i.items[op.Item.ID]
+	switch op.Op {
+	case BatchCreate:
+		if ok {
+			return ErrorAlreadyExists
+		}
+	case BatchUpdate:
+		if !ok {
+			return ErrorNotFound
+		}
+		if current.Revision != op.Item.Revision {
+			return ErrorConflict
+		}
+	case BatchDelete:
+		if !ok {
+			return ErrorNotFound
+		}
+		delete(i.items, op.Item.ID)
+		return nil
+	}
+	i.put(op.Item)
 	return nil
 }
 
-func (i *inMemoryStorage) delete(id string) error {
-	delete(i.items, id)
+// put stores item under a new revision.
+func (i *inMemoryStorage) put(item Item) {
+	i.revisions++
+	item.Revision = strconv.FormatUint(i.revisions, 10)
+	i.items[item.ID] = item
+}
+
+func (i *inMemoryStorage) Close() error {
 	return nil
 }
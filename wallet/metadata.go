@@ -13,6 +13,10 @@ type metadata struct {
 	TypeKey     []byte `json:"typeKey"`
 	NameKey     []byte `json:"nameKey"`
 	ItemKeyKey  []byte `json:"valueKeyKey"`
+
+	// PreviousItemKeyKey is set while item keys are re-encrypted under a new
+	// ItemKeyKey, for the items that have not been re-encrypted yet.
+	PreviousItemKeyKey []byte `json:"previousValueKeyKey,omitempty"`
 }
 
 type encodedMetadata struct {
@@ -22,17 +26,23 @@ type encodedMetadata struct {
 	TypeKey     string `json:"typeKey"`
 	NameKey     string `json:"nameKey"`
 	ValueKeyKey string `json:"valueKeyKey"`
+
+	PreviousValueKeyKey string `json:"previousValueKeyKey,omitempty"`
 }
 
 func (m *metadata) MarshalJSON() ([]byte, error) {
-	return json.Marshal(encodedMetadata{
+	e := encodedMetadata{
 		TagNameKey:  base64.StdEncoding.EncodeToString(m.TagNameKey),
 		TagValueKey: base64.StdEncoding.EncodeToString(m.TagValueKey),
 		HmacKey:     base64.StdEncoding.EncodeToString(m.HmacKey),
 		TypeKey:     base64.StdEncoding.EncodeToString(m.TypeKey),
 		NameKey:     base64.StdEncoding.EncodeToString(m.NameKey),
 		ValueKeyKey: base64.StdEncoding.EncodeToString(m.ItemKeyKey),
-	})
+	}
+	if m.PreviousItemKeyKey != nil {
+		e.PreviousValueKeyKey = base64.StdEncoding.EncodeToString(m.PreviousItemKeyKey)
+	}
+	return json.Marshal(e)
 }
 
 func (m *metadata) UnmarshalJSON(b []byte) error {
@@ -73,6 +83,13 @@ func (m *metadata) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	if e.PreviousValueKeyKey != "" {
+		m.PreviousItemKeyKey = make([]byte, chacha20poly1305.KeySize)
+		_, err = base64.StdEncoding.Decode(m.PreviousItemKeyKey, []byte(e.PreviousValueKeyKey))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
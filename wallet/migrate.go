@@ -0,0 +1,166 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrorMigrationMismatch is returned by Migrate and VerifyMigration when the
+// destination does not hold the same items as the source.
+var ErrorMigrationMismatch = errors.New("destination does not match source")
+
+// MigrateOption configures Migrate.
+type MigrateOption func(*migrateOptions)
+
+type migrateOptions struct {
+	cursor   string
+	progress func(cursor string, copied int)
+	pageSize int
+}
+
+// WithMigrateCursor resumes a migration from a cursor reported by the
+// WithMigrateProgress callback of an earlier run.
+func WithMigrateCursor(cursor string) MigrateOption {
+	return func(o *migrateOptions) {
+		o.cursor = cursor
+	}
+}
+
+// WithMigrateProgress calls progress after every page of items is copied,
+// with the cursor to resume from and the number of items copied so far.
+func WithMigrateProgress(progress func(cursor string, copied int)) MigrateOption {
+	return func(o *migrateOptions) {
+		o.progress = progress
+	}
+}
+
+// Migrate copies a wallet from src to dst, item by item, without decrypting
+// anything: the destination can be opened with the same password or
+// wrapper as the source. The wallet must not change while it is migrated.
+//
+// Items already in dst are skipped if they are identical to the source, so
+// an interrupted migration can be run again, optionally from the last cursor
+// it reported. Once every item is copied, dst is checked against src with
+// VerifyMigration.
+func Migrate(ctx context.Context, src, dst Storage, opts ...MigrateOption) error {
+	o := migrateOptions{pageSize: defaultPageSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// The metadata goes first, so that opening a partly migrated wallet
+	// fails instead of creating a new one
+	metadata, err := src.Read(ctx, metadataId)
+	if err != nil {
+		return err
+	}
+	if err = copyItem(ctx, dst, metadata); err != nil {
+		return err
+	}
+
+	copied := 0
+	cursor := o.cursor
+	for {
+		items, next, err := src.List(ctx, "", cursor, o.pageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range items {
+			if i.ID == metadataId {
+				continue
+			}
+			if err = copyItem(ctx, dst, i); err != nil {
+				return err
+			}
+			copied++
+		}
+
+		if o.progress != nil {
+			o.progress(next, copied)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	return VerifyMigration(ctx, src, dst)
+}
+
+// copyItem creates item in dst unless an identical item is already there.
+func copyItem(ctx context.Context, dst Storage, item Item) error {
+	item.Revision = ""
+	err := dst.Create(ctx, item)
+	if err != ErrorAlreadyExists {
+		return err
+	}
+
+	existing, err := dst.Read(ctx, item.ID)
+	if err != nil {
+		return err
+	}
+	if !sameItem(existing, item) {
+		return fmt.Errorf("%w: item %s differs", ErrorMigrationMismatch, item.ID)
+	}
+	return nil
+}
+
+// VerifyMigration checks that dst holds exactly the items of src, ignoring
+// their revisions.
+func VerifyMigration(ctx context.Context, src, dst Storage) error {
+	count := 0
+	cursor := ""
+	for {
+		items, next, err := src.List(ctx, "", cursor, defaultPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range items {
+			existing, err := dst.Read(ctx, i.ID)
+			if err == ErrorNotFound {
+				return fmt.Errorf("%w: item %s is missing", ErrorMigrationMismatch, i.ID)
+			} else if err != nil {
+				return err
+			}
+			if !sameItem(existing, i) {
+				return fmt.Errorf("%w: item %s differs", ErrorMigrationMismatch, i.ID)
+			}
+		}
+		count += len(items)
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	// Every item of src is in dst, so dst has extra items if it has more
+	cursor = ""
+	for {
+		items, next, err := dst.List(ctx, "", cursor, defaultPageSize)
+		if err != nil {
+			return err
+		}
+		count -= len(items)
+		if count < 0 {
+			return fmt.Errorf("%w: destination has items that are not in the source", ErrorMigrationMismatch)
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func sameItem(a, b Item) bool {
+	if len(a.Tags) == 0 && len(b.Tags) == 0 {
+		a.Tags, b.Tags = nil, nil
+	}
+	a.Revision, b.Revision = "", ""
+	return reflect.DeepEqual(a, b)
+}
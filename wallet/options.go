@@ -0,0 +1,95 @@
+package wallet
+
+import (
+	"context"
+	"time"
+)
+
+// Option configures a wallet when it is created or opened.
+type Option func(*options)
+
+type options struct {
+	keyDerivation KeyDerivation
+	keyCacheSize  int
+	keyCacheTTL   time.Duration
+	autoLock      time.Duration
+	auditLog      bool
+	ctx           context.Context
+
+	// mode restricts the constructors to creating or to opening a wallet.
+	mode openMode
+}
+
+type openMode int
+
+const (
+	createOrOpen openMode = iota
+	createOnly
+	openOnly
+)
+
+// withOpenMode is used by Manager, which knows whether a profile is to be
+// created or opened.
+func withOpenMode(mode openMode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{keyDerivation: KeyDerivationArgon2id, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithKeyDerivation sets the method used to derive the master key of a new
+// wallet. Existing wallets keep the method they were created with.
+func WithKeyDerivation(method KeyDerivation) Option {
+	return func(o *options) {
+		o.keyDerivation = method
+	}
+}
+
+// WithKeyCache keeps up to size recently used private keys decrypted in
+// memory for at most ttl, or without expiry if ttl is zero, so that
+// Sign, Seal and Open do not read them from storage on every call. Deleting
+// a key removes it from the cache, but a key deleted through another wallet
+// on the same storage remains usable here until its entry expires.
+func WithKeyCache(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.keyCacheSize = size
+		o.keyCacheTTL = ttl
+	}
+}
+
+// WithOpenContext sets the context of the storage calls made while creating
+// or opening the wallet, so that opening it on an unresponsive storage can be
+// cancelled or timed out. Use WithContext for the calls made afterwards.
+func WithOpenContext(ctx context.Context) Option {
+	return func(o *options) {
+		if ctx == nil {
+			panic("nil context")
+		}
+		o.ctx = ctx
+	}
+}
+
+// WithAutoLock locks the wallet, as Lock does, once it has not been used for
+// idle.
+func WithAutoLock(idle time.Duration) Option {
+	return func(o *options) {
+		o.autoLock = idle
+	}
+}
+
+// WithAuditLog makes the wallet append an entry to its audit log, see
+// AuditEntry, for every Sign, Seal, Open, OpenAnonymous, key creation,
+// DeleteKey and RotateKey, successful or not, including those of batches.
+// If the entry cannot be stored, the operation fails.
+func WithAuditLog() Option {
+	return func(o *options) {
+		o.auditLog = true
+	}
+}
@@ -0,0 +1,141 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorPolicyViolation is returned, wrapped with the reason, when a key is
+// used in a way its KeyPolicy does not allow.
+var ErrorPolicyViolation = errors.New("key policy violation")
+
+// KeyUsage is an operation a KeyPolicy can allow a key for.
+type KeyUsage string
+
+const (
+	// KeyUsageSign allows Sign.
+	KeyUsageSign KeyUsage = "sign"
+	// KeyUsageKeyAgreement allows Seal, Open and OpenAnonymous, as used by
+	// DIDComm.
+	KeyUsageKeyAgreement KeyUsage = "keyAgreement"
+	// KeyUsageEncrypt allows Encrypt and Decrypt.
+	KeyUsageEncrypt KeyUsage = "encrypt"
+)
+
+// KeyPolicy restricts how a key can be used. The zero policy allows
+// everything. A policy is set when the key is created and cannot be changed
+// afterwards, except on keys created without one.
+type KeyPolicy struct {
+	// Usages lists what the key can be used for, or is empty to allow any
+	// usage.
+	Usages []KeyUsage `json:"usages,omitempty"`
+
+	// NonExportable keeps the key out of Export.
+	NonExportable bool `json:"nonExportable,omitempty"`
+
+	// MaxUses is the number of times the key can be used, or zero for no
+	// limit. Every use of a limited key is counted in storage. Open and
+	// OpenAnonymous only count the messages they open, so that forged
+	// messages cannot use the key up.
+	MaxUses uint64 `json:"maxUses,omitempty"`
+
+	// Expires is when the key stops being usable, or zero if it never does.
+	Expires time.Time `json:"expires"`
+}
+
+// WithKeyPolicy sets the policy of a new key.
+func WithKeyPolicy(policy KeyPolicy) KeyOption {
+	return func(o *keyOptions) {
+		o.policy = &policy
+	}
+}
+
+// allows checks usage against the policy, apart from MaxUses.
+func (p *KeyPolicy) allows(usage KeyUsage, now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	if !p.Expires.IsZero() && now.After(p.Expires) {
+		return fmt.Errorf("%w: key expired at %s", ErrorPolicyViolation, p.Expires.Format(time.RFC3339))
+	}
+	if len(p.Usages) == 0 {
+		return nil
+	}
+	for _, u := range p.Usages {
+		if u == usage {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: key cannot be used for %s", ErrorPolicyViolation, usage)
+}
+
+// useKey reads a key for usage, enforcing its policy and counting the use
+// if the policy limits them. The key must be released with releaseKey.
+func (w *wallet) useKey(id string, usage KeyUsage) (*keyRecord, error) {
+	key, err := w.checkKey(id, usage)
+	if err != nil {
+		return nil, err
+	}
+	if err = w.chargeKey(id, key); err != nil {
+		w.releaseKey(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkKey reads a key for usage like useKey, without counting the use, which
+// is left to chargeKey.
+func (w *wallet) checkKey(id string, usage KeyUsage) (*keyRecord, error) {
+	key, err := w.readKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = key.Policy.allows(usage, time.Now()); err != nil {
+		w.releaseKey(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// chargeOpen counts the use of key to open a message, once it opened, and
+// wipes plaintext if the key was used up in the meantime.
+func (w *wallet) chargeOpen(id string, key *keyRecord, plaintext []byte) bool {
+	if w.chargeKey(id, key) != nil {
+		zero(plaintext)
+		return false
+	}
+	return true
+}
+
+// chargeKey counts a use of key if its policy limits them.
+func (w *wallet) chargeKey(id string, key *keyRecord) error {
+	if key.Policy == nil || key.Policy.MaxUses == 0 {
+		return nil
+	}
+	return w.countUse(id)
+}
+
+// countUse records a use of a key in storage, or fails once it has been used
+// MaxUses times. The cached key is not used, as other wallets may use the
+// key too.
+func (w *wallet) countUse(id string) error {
+	for {
+		var key keyRecord
+		revision, err := w.readKeyRecord(id, &key)
+		if err != nil {
+			return err
+		}
+
+		if key.Uses >= key.Policy.MaxUses {
+			key.zero()
+			return fmt.Errorf("%w: key was used %d times", ErrorPolicyViolation, key.Uses)
+		}
+		key.Uses++
+		err = w.update("_local/"+id, &key, WithRevision(revision))
+		key.zero()
+		if err != ErrorConflict {
+			return err
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package wallet
+
+import (
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil/base58"
+	"math/big"
+)
+
+// PublicKey is a public key of one of the asymmetric key types, in the same
+// encoding as key ids: 32 bytes for Ed25519 and X25519 keys and a compressed
+// point for ECDSA keys. It can be used without a wallet.
+type PublicKey struct {
+	Type KeyType
+	Key  []byte
+}
+
+var errorInvalidPublicKey = errors.New("invalid public key")
+
+// multicodecs are the multicodec prefixes of the public key types, as used in
+// did:key and publicKeyMultibase.
+var multicodecs = map[KeyType]uint64{
+	Ed25519VerificationKey2018Type:        0xed,
+	X25519KeyAgreementKey2019Type:         0xec,
+	EcdsaSecp256k1VerificationKey2019Type: 0xe7,
+	EcdsaSecp256r1VerificationKey2019Type: 0x1200,
+}
+
+// jwkCurves are the JWK "crv" values of the public key types.
+var jwkCurves = map[KeyType]string{
+	Ed25519VerificationKey2018Type:        "Ed25519",
+	X25519KeyAgreementKey2019Type:         "X25519",
+	EcdsaSecp256k1VerificationKey2019Type: "secp256k1",
+	EcdsaSecp256r1VerificationKey2019Type: "P-256",
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+// NewPublicKey validates a public key of the given type. ECDSA keys may be
+// given as compressed or uncompressed points.
+func NewPublicKey(typ KeyType, key []byte) (*PublicKey, error) {
+	switch typ {
+	case Ed25519VerificationKey2018Type, X25519KeyAgreementKey2019Type:
+		if len(key) != 32 {
+			return nil, errorInvalidPublicKey
+		}
+	case EcdsaSecp256k1VerificationKey2019Type:
+		pk, err := btcec.ParsePubKey(key, btcec.S256())
+		if err != nil {
+			return nil, errorInvalidPublicKey
+		}
+		key = pk.SerializeCompressed()
+	case EcdsaSecp256r1VerificationKey2019Type:
+		if len(key) == 65 {
+			x, y := elliptic.Unmarshal(elliptic.P256(), key)
+			if x == nil {
+				return nil, errorInvalidPublicKey
+			}
+			key = compressP256(x, y)
+		}
+		if _, _, err := decompressP256(key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrorInvalidKeyType
+	}
+	return &PublicKey{Type: typ, Key: append([]byte{}, key...)}, nil
+}
+
+// ParsePublicKeyBase58 parses a base58 encoded public key of the given type,
+// e.g. a verkey or a DID document's publicKeyBase58.
+func ParsePublicKeyBase58(typ KeyType, s string) (*PublicKey, error) {
+	return NewPublicKey(typ, base58.Decode(s))
+}
+
+// ParsePublicKeyMultibase parses a base58btc multibase encoded public key
+// prefixed with its multicodec, as in did:key identifiers.
+func ParsePublicKeyMultibase(s string) (*PublicKey, error) {
+	if len(s) < 2 || s[0] != 'z' {
+		return nil, errors.New("unsupported multibase encoding")
+	}
+
+	b := base58.Decode(s[1:])
+	codec, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, errorInvalidPublicKey
+	}
+	for typ, c := range multicodecs {
+		if c == codec {
+			return NewPublicKey(typ, b[n:])
+		}
+	}
+	return nil, ErrorInvalidKeyType
+}
+
+// ParseJWK parses a public key in JSON Web Key format.
+func ParseJWK(b []byte) (*PublicKey, error) {
+	var k jwk
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, err
+	}
+
+	var typ KeyType
+	for t, crv := range jwkCurves {
+		if crv == k.Crv {
+			typ = t
+		}
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case k.Kty == "OKP" && (typ == Ed25519VerificationKey2018Type || typ == X25519KeyAgreementKey2019Type):
+		return NewPublicKey(typ, x)
+	case k.Kty == "EC" && (typ == EcdsaSecp256k1VerificationKey2019Type || typ == EcdsaSecp256r1VerificationKey2019Type):
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errorInvalidPublicKey
+		}
+		return NewPublicKey(typ, append(append([]byte{4}, x...), y...))
+	}
+	return nil, ErrorInvalidKeyType
+}
+
+// Verify reports whether sig is a valid signature of data made with the
+// private key of k.
+func (k *PublicKey) Verify(data []byte, sig []byte) bool {
+	return verify(k.Type, k.Key, data, sig)
+}
+
+// Base58 returns the base58 encoded key, which is the key id in a wallet.
+func (k *PublicKey) Base58() string {
+	return base58.Encode(k.Key)
+}
+
+// Multibase returns the base58btc multibase encoded key with its multicodec
+// prefix.
+func (k *PublicKey) Multibase() string {
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, multicodecs[k.Type])
+	return "z" + base58.Encode(append(prefix[:n], k.Key...))
+}
+
+// JWK returns the key in JSON Web Key format.
+func (k *PublicKey) JWK() ([]byte, error) {
+	switch k.Type {
+	case Ed25519VerificationKey2018Type, X25519KeyAgreementKey2019Type:
+		return json.Marshal(jwk{Kty: "OKP", Crv: jwkCurves[k.Type], X: base64.RawURLEncoding.EncodeToString(k.Key)})
+	}
+
+	var x, y *big.Int
+	switch k.Type {
+	case EcdsaSecp256k1VerificationKey2019Type:
+		pk, err := btcec.ParsePubKey(k.Key, btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+		x, y = pk.X, pk.Y
+	case EcdsaSecp256r1VerificationKey2019Type:
+		var err error
+		if x, y, err = decompressP256(k.Key); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrorInvalidKeyType
+	}
+
+	return json.Marshal(jwk{
+		Kty: "EC",
+		Crv: jwkCurves[k.Type],
+		X:   base64.RawURLEncoding.EncodeToString(padScalar(x)),
+		Y:   base64.RawURLEncoding.EncodeToString(padScalar(y)),
+	})
+}
+
+// publicKey returns the public key for a key id. Keys held by the wallet have
+// their stored type, other ids are parsed as Ed25519 verkeys or multibase
+// keys.
+func (w *wallet) publicKey(id string) (*PublicKey, error) {
+	if key, err := w.readKey(id); err == nil {
+		defer w.releaseKey(key)
+		pk, err := key.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		return &PublicKey{Type: key.Type, Key: pk}, nil
+	} else if err != ErrorNotFound {
+		return nil, err
+	}
+
+	if pk, err := ParsePublicKeyBase58(Ed25519VerificationKey2018Type, id); err == nil {
+		return pk, nil
+	}
+	return ParsePublicKeyMultibase(id)
+}
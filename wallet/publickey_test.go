@@ -0,0 +1,86 @@
+package wallet
+
+import (
+	"testing"
+)
+
+func TestVerifyWithPublicKey(t *testing.T) {
+	w, err := NewWallet("supersecret", NewInMemoryStorage())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, typ := range []KeyType{
+		Ed25519VerificationKey2018Type,
+		EcdsaSecp256k1VerificationKey2019Type,
+		EcdsaSecp256r1VerificationKey2019Type,
+	} {
+		kid, err := w.CreateKey(typ)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sig, err := w.Sign(kid, []byte("message"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		pk, err := ParsePublicKeyBase58(typ, kid)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if pk.Base58() != kid {
+			t.Fatalf("Expected: %s, Actual: %s", kid, pk.Base58())
+		}
+
+		mpk, err := ParsePublicKeyMultibase(pk.Multibase())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		j, err := pk.JWK()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		jpk, err := ParseJWK(j)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		for _, k := range []*PublicKey{pk, mpk, jpk} {
+			if k.Type != typ {
+				t.Fatalf("Expected: %s, Actual: %s", typ, k.Type)
+			}
+			if !k.Verify([]byte("message"), sig) {
+				t.Fatalf("%s signature did not validate", typ)
+			}
+			if k.Verify([]byte("other message"), sig) {
+				t.Fatalf("%s signature validated for another message", typ)
+			}
+		}
+	}
+}
+
+func TestParsePublicKeyMultibase(t *testing.T) {
+	// Examples from the did:key method specification
+	for s, typ := range map[string]KeyType{
+		"z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK":  Ed25519VerificationKey2018Type,
+		"z6LSbysY2xFMRpGMhb7tFTLMpeuPRaqaWM1yECx2AtzE3KCc":  X25519KeyAgreementKey2019Type,
+		"zQ3shokFTS3brHcDQrn82RUDfCZESWL1ZdCEJwekUDPQiYBme": EcdsaSecp256k1VerificationKey2019Type,
+		"zDnaerDaTF5BXEavCrfRZEk316dpbLsfPDZ3WJ5hRTPFU2169": EcdsaSecp256r1VerificationKey2019Type,
+	} {
+		pk, err := ParsePublicKeyMultibase(s)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err.Error())
+		}
+		if pk.Type != typ {
+			t.Fatalf("Expected: %s, Actual: %s", typ, pk.Type)
+		}
+		if pk.Multibase() != s {
+			t.Fatalf("Expected: %s, Actual: %s", s, pk.Multibase())
+		}
+	}
+
+	if _, err := ParsePublicKeyMultibase("z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2do"); err == nil {
+		t.Fatal("Expected an error, got nil.")
+	}
+}
@@ -0,0 +1,246 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Tags are name/value pairs attached to a record so that it can be found
+// with Search. Tag names and values are encrypted before they reach the
+// storage backend, unless the tag name starts with "~", in which case the
+// value is stored in plaintext and can be used in range queries.
+type Tags map[string]string
+
+// Query selects records by their tags using the Wallet Query Language (WQL)
+// from Hyperledger Indy, e.g.
+//
+//	Query{
+//		"state": "active",
+//		"$or": []Query{
+//			{"~age": Query{"$gt": "18"}},
+//			{"thid": Query{"$in": []string{"a", "b"}}},
+//		},
+//	}
+//
+// Supported operators are $and, $or and $not to combine queries, and $eq,
+// $neq, $in for any tag. $gt, $gte, $lt and $lte are only supported on
+// plaintext tags.
+type Query map[string]interface{}
+
+// QueryOp is an operator of a StorageQuery.
+type QueryOp string
+
+const (
+	QueryAnd QueryOp = "$and"
+	QueryOr  QueryOp = "$or"
+	QueryNot QueryOp = "$not"
+	QueryEq  QueryOp = "$eq"
+	QueryNeq QueryOp = "$neq"
+	QueryGt  QueryOp = "$gt"
+	QueryGte QueryOp = "$gte"
+	QueryLt  QueryOp = "$lt"
+	QueryLte QueryOp = "$lte"
+	QueryIn  QueryOp = "$in"
+)
+
+// StorageQuery is a compiled Query, with tag names and values in the form
+// they are kept in storage. QueryAnd, QueryOr and QueryNot combine Queries,
+// the other operators compare the tag Name with Values.
+type StorageQuery struct {
+	Op      QueryOp
+	Name    string
+	Values  []string
+	Queries []StorageQuery
+}
+
+// Match reports whether the tags of an item satisfy q.
+func (q StorageQuery) Match(tags map[string]string) bool {
+	switch q.Op {
+	case QueryAnd:
+		for _, sub := range q.Queries {
+			if !sub.Match(tags) {
+				return false
+			}
+		}
+		return true
+	case QueryOr:
+		for _, sub := range q.Queries {
+			if sub.Match(tags) {
+				return true
+			}
+		}
+		return false
+	case QueryNot:
+		return !q.Queries[0].Match(tags)
+	}
+
+	value, ok := tags[q.Name]
+	if !ok {
+		return false
+	}
+
+	switch q.Op {
+	case QueryEq:
+		return value == q.Values[0]
+	case QueryNeq:
+		return value != q.Values[0]
+	case QueryGt:
+		return value > q.Values[0]
+	case QueryGte:
+		return value >= q.Values[0]
+	case QueryLt:
+		return value < q.Values[0]
+	case QueryLte:
+		return value <= q.Values[0]
+	case QueryIn:
+		for _, v := range q.Values {
+			if value == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isPlaintextTag(name string) bool {
+	return strings.HasPrefix(name, "~")
+}
+
+// compileQuery converts q into its storage form, encrypting tag names and
+// values with the wallet's tag keys.
+func (w *wallet) compileQuery(q Query) (StorageQuery, error) {
+	and := StorageQuery{Op: QueryAnd}
+	for name, value := range q {
+		var sub StorageQuery
+		var err error
+		switch QueryOp(name) {
+		case QueryAnd, QueryOr:
+			sub, err = w.compileQueries(QueryOp(name), value)
+		case QueryNot:
+			var v Query
+			if v, err = toQuery(value); err != nil {
+				return StorageQuery{}, err
+			}
+			var not StorageQuery
+			if not, err = w.compileQuery(v); err != nil {
+				return StorageQuery{}, err
+			}
+			sub = StorageQuery{Op: QueryNot, Queries: []StorageQuery{not}}
+		default:
+			sub, err = w.compileTagQuery(name, value)
+		}
+		if err != nil {
+			return StorageQuery{}, err
+		}
+		and.Queries = append(and.Queries, sub)
+	}
+	return and, nil
+}
+
+func (w *wallet) compileQueries(op QueryOp, value interface{}) (StorageQuery, error) {
+	var list []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		list = v
+	case []Query:
+		for _, q := range v {
+			list = append(list, q)
+		}
+	case []map[string]interface{}:
+		for _, q := range v {
+			list = append(list, q)
+		}
+	default:
+		return StorageQuery{}, fmt.Errorf("invalid query: %s expects a list of queries", op)
+	}
+
+	compiled := StorageQuery{Op: op}
+	for _, l := range list {
+		q, err := toQuery(l)
+		if err != nil {
+			return StorageQuery{}, err
+		}
+		sub, err := w.compileQuery(q)
+		if err != nil {
+			return StorageQuery{}, err
+		}
+		compiled.Queries = append(compiled.Queries, sub)
+	}
+	return compiled, nil
+}
+
+func (w *wallet) compileTagQuery(name string, value interface{}) (StorageQuery, error) {
+	op := QueryEq
+	var values []string
+
+	switch v := value.(type) {
+	case string:
+		values = []string{v}
+	case Query, map[string]interface{}:
+		q, _ := toQuery(v)
+		if len(q) != 1 {
+			return StorageQuery{}, fmt.Errorf("invalid query for tag %s", name)
+		}
+		for o, operand := range q {
+			op = QueryOp(o)
+			switch op {
+			case QueryEq, QueryNeq, QueryGt, QueryGte, QueryLt, QueryLte:
+				s, ok := operand.(string)
+				if !ok {
+					return StorageQuery{}, fmt.Errorf("invalid query: %s expects a string", op)
+				}
+				values = []string{s}
+			case QueryIn:
+				switch in := operand.(type) {
+				case []string:
+					values = in
+				case []interface{}:
+					for _, i := range in {
+						s, ok := i.(string)
+						if !ok {
+							return StorageQuery{}, fmt.Errorf("invalid query: %s expects a list of strings", op)
+						}
+						values = append(values, s)
+					}
+				default:
+					return StorageQuery{}, fmt.Errorf("invalid query: %s expects a list of strings", op)
+				}
+			default:
+				return StorageQuery{}, fmt.Errorf("invalid query: unknown operator %s", op)
+			}
+		}
+	default:
+		return StorageQuery{}, fmt.Errorf("invalid query for tag %s", name)
+	}
+
+	switch op {
+	case QueryGt, QueryGte, QueryLt, QueryLte:
+		if !isPlaintextTag(name) {
+			return StorageQuery{}, fmt.Errorf("invalid query: %s is only supported on plaintext tags", op)
+		}
+	}
+
+	ename, err := w.encryptTagName(name)
+	if err != nil {
+		return StorageQuery{}, err
+	}
+	evalues := make([]string, len(values))
+	for i, v := range values {
+		if evalues[i], err = w.encryptTagValue(name, v); err != nil {
+			return StorageQuery{}, err
+		}
+	}
+
+	return StorageQuery{Op: op, Name: ename, Values: evalues}, nil
+}
+
+func toQuery(v interface{}) (Query, error) {
+	switch q := v.(type) {
+	case Query:
+		return q, nil
+	case map[string]interface{}:
+		return q, nil
+	}
+	return nil, errors.New("invalid query: expected an object")
+}
@@ -0,0 +1,94 @@
+package wallet
+
+import "encoding/json"
+
+// Record is a decrypted wallet record, as returned by Search and List.
+type Record struct {
+	ID    string
+	Type  string
+	Tags  Tags
+	Value json.RawMessage
+
+	// Revision identifies the stored version of the record, see WithRevision.
+	Revision string
+}
+
+type RecordOption func(*recordOptions)
+
+type recordOptions struct {
+	typ      *string
+	tags     Tags
+	revision *string
+}
+
+// WithType sets the type of a record. Records can only be searched within a
+// type.
+func WithType(typ string) RecordOption {
+	return func(o *recordOptions) {
+		o.typ = &typ
+	}
+}
+
+// WithTags sets the tags of a record, replacing any existing tags on update.
+func WithTags(tags Tags) RecordOption {
+	return func(o *recordOptions) {
+		if tags == nil {
+			tags = Tags{}
+		}
+		o.tags = tags
+	}
+}
+
+// WithRevision makes Update fail with ErrorConflict unless the record is
+// still at the revision returned by ReadRevision, Search or List, so that
+// concurrent writers cannot overwrite each other's changes.
+func WithRevision(revision string) RecordOption {
+	return func(o *recordOptions) {
+		o.revision = &revision
+	}
+}
+
+const defaultPageSize = 100
+
+// RecordIterator walks through all records of a type, fetching them from
+// storage one page at a time.
+//
+//	it := w.Iterate("connection")
+//	for it.Next() {
+//		r := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type RecordIterator struct {
+	list    func(typ string, cursor string, limit int) ([]Record, string, error)
+	typ     string
+	cursor  string
+	page    []Record
+	current Record
+	done    bool
+	err     error
+}
+
+// Next advances the iterator and reports whether a record is available.
+func (it *RecordIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.page, it.cursor, it.err = it.list(it.typ, it.cursor, defaultPageSize)
+		it.done = it.cursor == ""
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Record returns the current record.
+func (it *RecordIterator) Record() Record {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *RecordIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,158 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Rekey changes the wallet password. Only the metadata is re-encrypted, under
+// a master key derived from the new password with a new salt.
+func (w *wallet) Rekey(oldPassword, newPassword string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.metadata == nil {
+		return ErrorLocked
+	}
+	if w.wrapper != nil {
+		return errorWrapped
+	}
+
+	current, err := w.storage.Read(w.ctx, metadataId)
+	if err != nil {
+		return err
+	}
+	if _, _, err = decryptMetadata(current, oldPassword); err != nil {
+		return err
+	}
+
+	return w.storeMetadata(current, w.metadata, newPassword)
+}
+
+// RekeyFull changes the wallet password like Rekey, and also replaces the key
+// that encrypts the item key of every record, re-encrypting the item keys in
+// storage. If it is interrupted, calling it again with the new password
+// completes the rotation. Other wallets open on the same storage must be
+// reopened afterwards.
+func (w *wallet) RekeyFull(oldPassword, newPassword string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.metadata == nil {
+		return ErrorLocked
+	}
+	if w.wrapper != nil {
+		return errorWrapped
+	}
+
+	current, err := w.storage.Read(w.ctx, metadataId)
+	if err != nil {
+		return err
+	}
+	if _, _, err = decryptMetadata(current, oldPassword); err != nil {
+		return err
+	}
+
+	// Finish an interrupted rotation first, so that no item is left
+	// encrypted under a key that is about to be discarded.
+	if w.metadata.PreviousItemKeyKey != nil {
+		if err = w.rewrapItemKeys(); err != nil {
+			return err
+		}
+	}
+
+	rotated := *w.metadata
+	rotated.PreviousItemKeyKey = w.metadata.ItemKeyKey
+	rotated.ItemKeyKey = make([]byte, chacha20poly1305.KeySize)
+	if _, err = rand.Read(rotated.ItemKeyKey); err != nil {
+		return err
+	}
+
+	if err = w.storeMetadata(current, &rotated, newPassword); err != nil {
+		return err
+	}
+
+	if err = w.rewrapItemKeys(); err != nil {
+		return err
+	}
+
+	if current, err = w.storage.Read(w.ctx, metadataId); err != nil {
+		return err
+	}
+	completed := rotated
+	completed.PreviousItemKeyKey = nil
+	if err = w.storeMetadata(current, &completed, newPassword); err != nil {
+		return err
+	}
+	zero(rotated.PreviousItemKeyKey)
+	return nil
+}
+
+// rewrapItemKeys re-encrypts every item key still encrypted under the
+// previous item key key.
+func (w *wallet) rewrapItemKeys() error {
+	cursor := ""
+	for {
+		items, next, err := w.storage.List(w.ctx, "", cursor, defaultPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range items {
+			if i.ID == metadataId {
+				continue
+			}
+			if _, err := decrypt(w.metadata.ItemKeyKey, i.ItemKey); err == nil {
+				continue
+			}
+
+			itemKey, err := decrypt(w.metadata.PreviousItemKeyKey, i.ItemKey)
+			if err != nil {
+				return err
+			}
+			if i.ItemKey, err = encrypt(w.metadata.ItemKeyKey, itemKey); err != nil {
+				return err
+			}
+			if err = w.storage.Update(w.ctx, i); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+var errorWrapped = errors.New("wallet metadata is wrapped and has no password")
+
+// storeMetadata replaces the stored metadata with m, encrypted under a master
+// key derived from password with a new salt.
+func (w *wallet) storeMetadata(current Item, m *metadata, password string) error {
+	params, err := newKDFParams(w.kdf.Method)
+	if err != nil {
+		return err
+	}
+
+	key, err := params.deriveKey(password)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+
+	ciphertext, err := encryptMetadata(m, key, params)
+	if err != nil {
+		return err
+	}
+
+	err = w.storage.Update(w.ctx, Item{ID: metadataId, Revision: current.Revision, Value: ciphertext})
+	if err != nil {
+		return err
+	}
+
+	w.metadata = m
+	w.kdf = params
+	return nil
+}
@@ -0,0 +1,158 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrorKeyRetired is returned when signing or encrypting with a key that
+// RotateKey replaced, or rotating it again.
+var ErrorKeyRetired = errors.New("key is retired")
+
+// KeyOption sets metadata of a key.
+type KeyOption func(*keyOptions)
+
+type keyOptions struct {
+	did     *string
+	purpose *string
+	tags    Tags
+	policy  *KeyPolicy
+}
+
+func newKeyOptions(opts []KeyOption) keyOptions {
+	var o keyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithKeyDID records the DID a key belongs to.
+func WithKeyDID(did string) KeyOption {
+	return func(o *keyOptions) {
+		o.did = &did
+	}
+}
+
+// WithKeyPurpose records what a key is used for, such as "authentication"
+// or "keyAgreement".
+func WithKeyPurpose(purpose string) KeyOption {
+	return func(o *keyOptions) {
+		o.purpose = &purpose
+	}
+}
+
+// WithKeyTags sets free-form tags on a key, replacing any existing ones.
+func WithKeyTags(tags Tags) KeyOption {
+	return func(o *keyOptions) {
+		if tags == nil {
+			tags = Tags{}
+		}
+		o.tags = tags
+	}
+}
+
+func (o keyOptions) apply(k *keyRecord) {
+	if o.did != nil {
+		k.DID = *o.did
+	}
+	if o.purpose != nil {
+		k.Purpose = *o.purpose
+	}
+	if o.tags != nil {
+		k.Tags = o.tags
+	}
+	if o.policy != nil {
+		k.Policy = o.policy
+	}
+}
+
+// ReadKeyInfo returns the metadata of a key.
+func (w *wallet) ReadKeyInfo(id string) (KeyInfo, error) {
+	if err := w.rlock(); err != nil {
+		return KeyInfo{}, err
+	}
+	defer w.mu.RUnlock()
+
+	// Not from the key cache, whose copy may be out of date
+	var key keyRecord
+	if _, err := w.readKeyRecord(id, &key); err != nil {
+		return KeyInfo{}, err
+	}
+	key.zero()
+	return key.info(id), nil
+}
+
+// UpdateKeyInfo changes the metadata of a key, for instance to record the
+// DID it was created for once the DID is known. It fails with
+// ErrorPolicyViolation if it would replace the policy of the key.
+func (w *wallet) UpdateKeyInfo(id string, opts ...KeyOption) error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
+	var key keyRecord
+	revision, err := w.readKeyRecord(id, &key)
+	if err != nil {
+		return err
+	}
+	defer key.zero()
+
+	o := newKeyOptions(opts)
+	if o.policy != nil && key.Policy != nil {
+		return fmt.Errorf("%w: the policy of a key cannot be changed", ErrorPolicyViolation)
+	}
+	o.apply(&key)
+	if err = w.update("_local/"+id, &key, WithRevision(revision)); err != nil {
+		return err
+	}
+	w.keys.remove(id)
+	return nil
+}
+
+// RotateKey replaces a key with a new one of the same type, metadata and
+// policy, and returns the id of the new key. The old key is kept, retired:
+// it can still open messages sealed to it and verify its signatures, but no
+// longer sign or seal. The two keys refer to each other through the
+// ReplacedBy and Replaces fields of their KeyInfo, so that the history of a
+// key can be followed.
+func (w *wallet) RotateKey(id string) (_ string, err error) {
+	if err = w.rlock(); err != nil {
+		return "", err
+	}
+	defer w.mu.RUnlock()
+	defer w.audit(AuditRotateKey, id, &err)
+
+	var old keyRecord
+	revision, err := w.readKeyRecord(id, &old)
+	if err != nil {
+		return "", err
+	}
+	defer old.zero()
+	if old.ReplacedBy != "" {
+		return "", ErrorKeyRetired
+	}
+
+	b := &Batch{w: w, metadata: w.metadata}
+	o := keyOptions{did: &old.DID, purpose: &old.Purpose, tags: old.Tags, policy: old.Policy}
+	newID, err := b.createKey(old.Type, o, id)
+	if err != nil {
+		return "", err
+	}
+
+	old.ReplacedBy = newID
+	old.Rotated = time.Now().Unix()
+	item, err := w.updatedItem("_local/"+id, &old, []RecordOption{WithRevision(revision)})
+	if err != nil {
+		return "", err
+	}
+	b.ops = append(b.ops, BatchOperation{Op: BatchUpdate, Item: item})
+
+	if err = b.commit(); err != nil {
+		return "", err
+	}
+	w.keys.remove(id)
+	return newID, nil
+}
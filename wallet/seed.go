@@ -0,0 +1,89 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"errors"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// SeedSize is the size of the seeds accepted by CreateKeyFromSeed.
+const SeedSize = 32
+
+var errorInvalidSeed = errors.New("seed is not a valid private key")
+
+// slip10Curves are the SLIP-0010 master key HMAC keys of the supported key
+// types.
+var slip10Curves = map[KeyType]string{
+	Ed25519VerificationKey2018Type:        "ed25519 seed",
+	X25519KeyAgreementKey2019Type:         "curve25519 seed",
+	EcdsaSecp256k1VerificationKey2019Type: "Bitcoin seed",
+	EcdsaSecp256r1VerificationKey2019Type: "Nist256p1 seed",
+}
+
+// CreateKeyFromSeed creates a key of the given type from a 32 byte seed. The
+// same seed always yields the same key, and Ed25519 keys match those of
+// Hyperledger Indy wallets created from the seed.
+func (w *wallet) CreateKeyFromSeed(typ KeyType, seed []byte) (string, error) {
+	if err := w.rlock(); err != nil {
+		return "", err
+	}
+	defer w.mu.RUnlock()
+
+	id, key, err := keyFromSeed(typ, seed)
+	if err != nil {
+		return "", err
+	}
+
+	return w.storeKey(id, key, keyOptions{})
+}
+
+// CreateKeyFromMnemonic creates a key of the given type from a BIP-39
+// mnemonic and optional passphrase. The key is the SLIP-0010 master key of
+// the BIP-39 seed, so it can be recovered from the mnemonic.
+func (w *wallet) CreateKeyFromMnemonic(typ KeyType, mnemonic, passphrase string) (string, error) {
+	seed, err := MnemonicToSeed(mnemonic, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	curve, ok := slip10Curves[typ]
+	if !ok {
+		return "", ErrorInvalidKeyType
+	}
+
+	key, _ := slip10MasterKey(typ, curve, seed)
+	return w.CreateKeyFromSeed(typ, key)
+}
+
+// NewMnemonic returns a random 24 word BIP-39 mnemonic to back up keys
+// created with CreateKeyFromMnemonic.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(256)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// MnemonicToSeed validates a BIP-39 mnemonic and returns its 64 byte seed.
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	return bip39.NewSeedWithErrorChecking(mnemonic, passphrase)
+}
+
+// slip10MasterKey returns the SLIP-0010 master private key and chain code of
+// seed, retrying as specified while the key is not a valid private key for
+// typ.
+func slip10MasterKey(typ KeyType, curve string, seed []byte) (key []byte, chainCode []byte) {
+	data := seed
+	for {
+		mac := hmac.New(sha512.New, []byte(curve))
+		mac.Write(data)
+		i := mac.Sum(nil)
+
+		if _, _, err := keyFromSeed(typ, i[:32]); err != errorInvalidSeed {
+			return i[:32], i[32:]
+		}
+		data = i
+	}
+}
@@ -0,0 +1,80 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcutil/base58"
+	"testing"
+)
+
+func TestIndySeedToVerkey(t *testing.T) {
+	// Well known Indy trustee seed, e.g. in indy-sdk and aries-cloudagent tests
+	id, _, err := keyFromSeed(Ed25519VerificationKey2018Type, []byte("000000000000000000000000Trustee1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != "GJ1SzoWzavQYfNL9XkaJdrQejfztN4XqdsiV4ct3LXKL" {
+		t.Fatalf("Expected: %s, Actual: %s", "GJ1SzoWzavQYfNL9XkaJdrQejfztN4XqdsiV4ct3LXKL", id)
+	}
+	if did := base58.Encode(base58.Decode(id)[:16]); did != "V4SGRU86Z58d6TV7PBUe6f" {
+		t.Fatalf("Expected: %s, Actual: %s", "V4SGRU86Z58d6TV7PBUe6f", did)
+	}
+}
+
+func TestSLIP10MasterKey(t *testing.T) {
+	// Test vector 1 from SLIP-0010
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+	for typ, expected := range map[KeyType]string{
+		Ed25519VerificationKey2018Type:        "2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7",
+		EcdsaSecp256k1VerificationKey2019Type: "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35",
+		EcdsaSecp256r1VerificationKey2019Type: "612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2",
+	} {
+		key, _ := slip10MasterKey(typ, slip10Curves[typ], seed)
+		if hex.EncodeToString(key) != expected {
+			t.Fatalf("%s Expected: %s, Actual: %x", typ, expected, key)
+		}
+	}
+}
+
+func TestMnemonicToSeed(t *testing.T) {
+	// Test vector from BIP-39
+	seed, err := MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "TREZOR")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"
+	if hex.EncodeToString(seed) != expected {
+		t.Fatalf("Expected: %s, Actual: %x", expected, seed)
+	}
+
+	_, err = MnemonicToSeed("abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon", "")
+	if err == nil {
+		t.Fatal("Expected an error, got nil.")
+	}
+}
+
+func TestSLIP10DeriveEd25519(t *testing.T) {
+	// Test vector 1 from SLIP-0010
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+
+	for path, expected := range map[string]string{
+		"m":                         "2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7",
+		"m/0'":                      "68e0fe46dfb67e368c75379acec591dad19df3cde26e63b93a8e704f1dade7a3",
+		"m/0'/1'/2'/2'/1000000000'": "8f94d394a8e8fd6b1bc2f3f49f5c47e385281d5c17e65324b0f62483e37e8793",
+		"m/0h/1h/2h/2h/1000000000h": "8f94d394a8e8fd6b1bc2f3f49f5c47e385281d5c17e65324b0f62483e37e8793",
+	} {
+		key, err := slip10DeriveEd25519(seed, path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if hex.EncodeToString(key) != expected {
+			t.Fatalf("%s Expected: %s, Actual: %x", path, expected, key)
+		}
+	}
+
+	for _, path := range []string{"0'/1'", "m/0", "m/x'", "m/2147483648'"} {
+		if _, err := slip10DeriveEd25519(seed, path); err == nil {
+			t.Fatalf("%s Expected an error, got nil.", path)
+		}
+	}
+}
@@ -1,19 +1,99 @@
 package wallet
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"io"
+)
 
 var ErrorNotFound = errors.New("not found")
 
+// ErrorAlreadyExists is returned when creating an item whose id is taken.
+var ErrorAlreadyExists = errors.New("already exists")
+
+// ErrorConflict is returned when an item was changed since the revision it
+// is updated from was read.
+var ErrorConflict = errors.New("revision conflict")
+
+// Storage is the backend a wallet keeps its items in. Items reach the
+// storage already encrypted: ids, types, tag names and encrypted tag values
+// are deterministic ciphertexts, so a backend can index and compare them but
+// never sees the plaintext. Implementations outside this package can be
+// passed to NewWallet, and must be safe for concurrent use.
 type Storage interface {
-	create(item item) error
-	read(id string) (item item, err error)
-	update(item item) error
-	delete(id string) error
+	// Create stores a new item, or returns ErrorAlreadyExists.
+	Create(ctx context.Context, item Item) error
+
+	// Read returns the item with the given id, or ErrorNotFound.
+	Read(ctx context.Context, id string) (item Item, err error)
+
+	// Update replaces the stored item with the same id if it is still at
+	// item.Revision, and returns ErrorConflict otherwise. The check and the
+	// write must be atomic.
+	Update(ctx context.Context, item Item) error
+
+	// Delete removes the item with the given id, or returns ErrorNotFound.
+	Delete(ctx context.Context, id string) error
+
+	// Search returns every item of the given type whose tags match q.
+	Search(ctx context.Context, typ string, q StorageQuery) (items []Item, err error)
+
+	// List returns up to limit items of the given type ordered by id,
+	// starting after cursor. An empty type lists every item in storage. A
+	// limit of zero or less stands for a page of the default size. A
+	// non-empty next is the cursor of the following page.
+	List(ctx context.Context, typ string, cursor string, limit int) (items []Item, next string, err error)
+
+	// Close releases the resources held by the storage.
+	io.Closer
 }
 
-type item struct {
-	ID       string `json:"_id"`
+// Item is a record as it is kept in storage.
+type Item struct {
+	// ID is the encrypted record id.
+	ID string `json:"_id"`
+
+	// Revision is an opaque version string maintained by the backend. It
+	// changes on every update.
 	Revision string `json:"_rev,omitempty"`
-	Item     string `json:"item"`
-	ItemKey  string `json:"itemKey,omitempty"`
+
+	// Type is the encrypted record type.
+	Type string `json:"type,omitempty"`
+
+	// Tags maps encrypted tag names to their encrypted, or for plaintext
+	// tags unencrypted, values.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Value is the encrypted record value.
+	Value string `json:"item"`
+
+	// ItemKey is the key Value is encrypted with, itself encrypted with
+	// the wallet's item key key.
+	ItemKey string `json:"itemKey,omitempty"`
+}
+
+// BatchOp is the kind of change a BatchOperation makes.
+type BatchOp string
+
+const (
+	BatchCreate BatchOp = "create"
+	BatchUpdate BatchOp = "update"
+	BatchDelete BatchOp = "delete"
+)
+
+// BatchOperation is a change to one item in a batch. Deletions only use the
+// id of Item.
+type BatchOperation struct {
+	Op   BatchOp
+	Item Item
+}
+
+// BatchStorage is implemented by storages that can apply several changes
+// together. Batch applies all operations, with the same checks as Create
+// and Update and with ErrorNotFound for deletions of missing items, or
+// returns the error of the first one that fails and leaves storage as it
+// was.
+type BatchStorage interface {
+	Storage
+	Batch(ctx context.Context, ops []BatchOperation) error
 }
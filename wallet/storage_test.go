@@ -0,0 +1,41 @@
+package wallet_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetreaulttech/ssi/wallet"
+)
+
+// countingStorage is a backend implemented outside the wallet package.
+type countingStorage struct {
+	wallet.Storage
+	creates int
+}
+
+func (c *countingStorage) Create(ctx context.Context, item wallet.Item) error {
+	c.creates++
+	return c.Storage.Create(ctx, item)
+}
+
+func TestExternalStorage(t *testing.T) {
+	s := &countingStorage{Storage: wallet.NewInMemoryStorage()}
+	w, err := wallet.NewWallet("password", s)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err = w.Create("test", "value"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var value string
+	if err = w.Read("test", &value); err != nil {
+		t.Fatal(err.Error())
+	}
+	if value != "value" {
+		t.Fatalf("Expected: %s, Actual: %s", "value", value)
+	}
+	if s.creates != 2 {
+		t.Fatalf("Expected: %d, Actual: %d", 2, s.creates)
+	}
+}
@@ -1,35 +1,61 @@
 package wallet
 
 import (
+	"context"
 	"crypto"
-	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	_ "crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"github.com/btcsuite/btcutil/base58"
-	"github.com/teserakt-io/golang-ed25519/extra25519"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/nacl/box"
-	"golang.org/x/crypto/pbkdf2"
 	"io"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Wallet is a store of encrypted records and keys. It is safe for concurrent
+// use by multiple goroutines, provided its storage is; all storages in this
+// package are. Operations run concurrently except Rekey, RekeyFull, Lock,
+// Unlock and Close, which wait for the others to finish.
 type Wallet interface {
-	Create(id string, item interface{}) error
+	// WithContext returns a view of the wallet whose operations use ctx for
+	// every storage call they make, so that they are abandoned once ctx is
+	// cancelled or its deadline passes. The view shares its keys and storage
+	// with the wallet it was created from.
+	WithContext(ctx context.Context) Wallet
+
+	Create(id string, item interface{}, opts ...RecordOption) error
 	Read(id string, out interface{}) error
-	Update(id string, item interface{}) error
+	ReadRevision(id string, out interface{}) (revision string, err error)
+	Update(id string, item interface{}, opts ...RecordOption) error
 	Delete(id string) error
-
-	CreateKey(typ KeyType) (string, error)
+	Search(typ string, query Query) ([]Record, error)
+	List(typ string, cursor string, limit int) (records []Record, next string, err error)
+	Iterate(typ string) *RecordIterator
+	NewBatch() (*Batch, error)
+
+	Export(path string, exportKey string) error
+	Import(path string, exportKey string) error
+
+	CreateKey(typ KeyType, opts ...KeyOption) (string, error)
+	CreateKeyFromSeed(typ KeyType, seed []byte) (string, error)
+	CreateKeyFromMnemonic(typ KeyType, mnemonic, passphrase string) (string, error)
+	SetMasterSeed(seed []byte) error
+	DeriveKey(typ KeyType, path string) (string, error)
+	RestoreDerivedKeys(count uint32) ([]string, error)
 	DeleteKey(id string) error
 	KeyExists(id string) bool
+	ListKeys(cursor string, limit int) (keys []KeyInfo, next string, err error)
+	ReadKeyInfo(id string) (KeyInfo, error)
+	UpdateKeyInfo(id string, opts ...KeyOption) error
+	RotateKey(id string) (newID string, err error)
 
-	Encrypt(id string, data []byte) (ciphertext []byte, err error)
-	Decrypt(id string, ciphertext []byte) (data []byte, err error)
+	Encrypt(id string, data []byte, additionalData []byte) (ciphertext []byte, err error)
+	Decrypt(id string, ciphertext []byte, additionalData []byte) (data []byte, err error)
 
 	Sign(id string, data []byte) ([]byte, error)
 	Verify(id string, data []byte, sig []byte) bool
@@ -38,293 +64,1000 @@ type Wallet interface {
 	SealAnonymous(message []byte, receiverKey string) (encrypted []byte, err error)
 	Open(ciphertext []byte, nonce []byte, senderKey, receiverKey string) (plaintext []byte, res bool)
 	OpenAnonymous(ciphertext []byte, receiverKey string) (plaintext []byte, res bool)
+
+	Rekey(oldPassword, newPassword string) error
+	RekeyFull(oldPassword, newPassword string) error
+
+	Lock()
+	Unlock(password string) error
+	Close() error
+
+	ReadAuditLog(from uint64, limit int) ([]AuditEntry, error)
+	VerifyAuditLog() error
+	RepairAuditLog() error
 }
 
+var ErrorInvalidPassword = errors.New("invalid password")
+
 type wallet struct {
+	*walletState
+	ctx context.Context
+}
+
+// walletState is shared by a wallet and the views returned by WithContext.
+//
+// Every exported method holds mu for reading while it runs, and never calls
+// another exported method, so that RekeyFull can hold it for writing while
+// it replaces the metadata and re-encrypts the item keys.
+type walletState struct {
+	// lastUsed is the time of the last operation in nanoseconds, accessed
+	// atomically.
+	lastUsed int64
+
+	mu sync.RWMutex
+
 	metadata *metadata
+	kdf      kdfParams
 	storage  Storage
 	wrapper  Wrapper
+	keys     *keyCache
+
+	// autoLock is the idle time after which timer locks the wallet.
+	autoLock time.Duration
+	timer    *time.Timer
+	closed   bool
+
+	// auditLog is set if key operations are recorded in the audit log.
+	auditLog bool
 }
 
-func NewWallet(password string, s Storage) (Wallet, error) {
-	masterKey := pbkdf2.Key([]byte(password), []byte("saltsaltsaltsalt"), 100000, 32, crypto.SHA512.New)
+func NewWallet(password string, s Storage, opts ...Option) (Wallet, error) {
+	o := newOptions(opts)
 
 	var metadata *metadata
-
-	m, err := s.read(metadataId)
-	if err == ErrorNotFound {
-		metadata, err = generateMetadata(masterKey, s)
+	var params kdfParams
+
+	m, err := s.Read(o.ctx, metadataId)
+	if err == ErrorNotFound && o.mode == openOnly {
+		return nil, ErrorNotFound
+	} else if err == nil && o.mode == createOnly {
+		return nil, ErrorAlreadyExists
+	} else if err == ErrorNotFound {
+		if params, err = newKDFParams(o.keyDerivation); err != nil {
+			return nil, err
+		}
+		masterKey, err := params.deriveKey(password)
+		if err != nil {
+			return nil, err
+		}
+		defer zero(masterKey)
+		if metadata, err = newMetadata(); err != nil {
+			return nil, err
+		}
+		ciphertext, err := encryptMetadata(metadata, masterKey, params)
 		if err != nil {
 			return nil, err
 		}
+		if err = s.Create(o.ctx, Item{ID: metadataId, Value: ciphertext}); err != nil {
+			return nil, err
+		}
 	} else if err != nil {
 		return nil, err
 	} else {
-		metadata, err = decryptMetadata(m, masterKey)
+		metadata, params, err = decryptMetadata(m, password)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &wallet{storage: s, metadata: metadata}, nil
+	state := &walletState{storage: s, metadata: metadata, kdf: params, keys: newKeyCache(o.keyCacheSize, o.keyCacheTTL), autoLock: o.autoLock, auditLog: o.auditLog}
+	state.startAutoLock()
+	return &wallet{walletState: state, ctx: context.Background()}, nil
 }
 
-func NewWalletWithWrapper(password string, storage Storage, wrapper Wrapper) (Wallet, error) {
-	return &wallet{storage: storage, wrapper: wrapper}, nil
-}
+// NewWalletWithWrapper creates or opens a wallet whose metadata is protected
+// by wrapper instead of a key derived from a password. WithKeyDerivation does
+// not apply to such wallets.
+func NewWalletWithWrapper(s Storage, wrapper Wrapper, opts ...Option) (Wallet, error) {
+	o := newOptions(opts)
 
-func (w *wallet) Create(id string, i interface{}) error {
-	eid, err := encryptSearcheable(w.metadata.NameKey, w.metadata.HmacKey, []byte(id))
-	if err != nil {
-		return err
+	var metadata *metadata
+
+	m, err := s.Read(o.ctx, metadataId)
+	if err == ErrorNotFound && o.mode == openOnly {
+		return nil, ErrorNotFound
+	} else if err == nil && o.mode == createOnly {
+		return nil, ErrorAlreadyExists
+	} else if err == ErrorNotFound {
+		if metadata, err = newMetadata(); err != nil {
+			return nil, err
+		}
+		wrapped, err := wrapMetadata(metadata, wrapper)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.Create(o.ctx, Item{ID: metadataId, Value: wrapped}); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		metadata, err = unwrapMetadata(m, wrapper)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	valueKey := make([]byte, chacha20poly1305.KeySize)
-	_, err = rand.Read(valueKey)
-	if err != nil {
-		return err
+	state := &walletState{storage: s, metadata: metadata, wrapper: wrapper, keys: newKeyCache(o.keyCacheSize, o.keyCacheTTL), autoLock: o.autoLock, auditLog: o.auditLog}
+	state.startAutoLock()
+	return &wallet{walletState: state, ctx: context.Background()}, nil
+}
+
+func (w *wallet) WithContext(ctx context.Context) Wallet {
+	if ctx == nil {
+		panic("nil context")
 	}
+	return &wallet{walletState: w.walletState, ctx: ctx}
+}
 
-	m, err := json.Marshal(i)
-	if err != nil {
+func (w *wallet) Create(id string, i interface{}, opts ...RecordOption) error {
+	if err := w.rlock(); err != nil {
 		return err
 	}
+	defer w.mu.RUnlock()
 
-	eitem, err := encrypt(valueKey, m)
-	if err != nil {
-		return err
+	if isAuditRecord(id) {
+		return errorAuditRecord
 	}
+	return w.create(id, i, opts...)
+}
 
-	evalueKey, err := encrypt(w.metadata.ItemKeyKey, valueKey)
+func (w *wallet) create(id string, i interface{}, opts ...RecordOption) error {
+	storageItem, err := w.newItem(id, i, opts)
 	if err != nil {
 		return err
 	}
 
-	storageItem := item{
-		ID:      eid,
-		Item:    eitem,
-		ItemKey: evalueKey,
+	return w.storage.Create(w.ctx, storageItem)
+}
+
+func (w *wallet) newItem(id string, i interface{}, opts []RecordOption) (Item, error) {
+	var o recordOptions
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	return w.storage.create(storageItem)
+	return w.encryptItem(id, i, o.typ, o.tags)
 }
 
 func (w *wallet) Read(id string, out interface{}) error {
+	if err := w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+
 	if strings.HasPrefix(id, "_local/") {
 		return errors.New("item cannot be extracted")
 	}
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
 
 	return w.read(id, out)
 }
 
+// ReadRevision reads a record like Read and returns its revision, which can
+// be passed to Update with WithRevision.
+func (w *wallet) ReadRevision(id string, out interface{}) (string, error) {
+	if err := w.rlock(); err != nil {
+		return "", err
+	}
+	defer w.mu.RUnlock()
+
+	if strings.HasPrefix(id, "_local/") {
+		return "", errors.New("item cannot be extracted")
+	}
+	if isAuditRecord(id) {
+		return "", errorAuditRecord
+	}
+
+	return w.readRevision(id, out)
+}
+
 func (w *wallet) read(id string, out interface{}) error {
+	_, err := w.readRevision(id, out)
+	return err
+}
+
+func (w *wallet) readRevision(id string, out interface{}) (string, error) {
 	eid, err := encryptSearcheable(w.metadata.NameKey, w.metadata.HmacKey, []byte(id))
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	storageItem, err := w.storage.read(eid)
+	storageItem, err := w.storage.Read(w.ctx, eid)
 	if err != nil {
+		return "", err
+	}
+
+	item, err := w.decryptValue(storageItem)
+	if err != nil {
+		return "", err
+	}
+	defer zero(item)
+
+	return storageItem.Revision, json.Unmarshal(item, out)
+}
+
+func (w *wallet) Update(id string, i interface{}, opts ...RecordOption) error {
+	if err := w.rlock(); err != nil {
 		return err
 	}
+	defer w.mu.RUnlock()
 
-	itemKey, err := decrypt(w.metadata.ItemKeyKey, storageItem.ItemKey)
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
+	return w.update(id, i, opts...)
+}
+
+func (w *wallet) update(id string, i interface{}, opts ...RecordOption) error {
+	storageItem, err := w.updatedItem(id, i, opts)
 	if err != nil {
 		return err
 	}
 
-	item, err := decrypt(itemKey, storageItem.Item)
+	return w.storage.Update(w.ctx, storageItem)
+}
+
+// updatedItem encrypts the new value of an existing record.
+func (w *wallet) updatedItem(id string, i interface{}, opts []RecordOption) (Item, error) {
+	var o recordOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Keep the type and tags of the existing record unless replaced, and
+	// only replace the revision that was read
+	current, err := w.decryptStoredRecord(id)
+	if err != nil {
+		return Item{}, err
+	}
+	if o.revision != nil && *o.revision != current.Revision {
+		return Item{}, ErrorConflict
+	}
+
+	typ, tags := o.typ, o.tags
+	if typ == nil {
+		typ = &current.Type
+	}
+	if tags == nil {
+		tags = current.Tags
+	}
+
+	storageItem, err := w.encryptItem(id, i, typ, tags)
 	if err != nil {
+		return Item{}, err
+	}
+	storageItem.Revision = current.Revision
+	return storageItem, nil
+}
+
+func (w *wallet) Delete(id string) error {
+	if err := w.rlock(); err != nil {
 		return err
 	}
+	defer w.mu.RUnlock()
 
-	return json.Unmarshal(item, out)
+	if isAuditRecord(id) {
+		return errorAuditRecord
+	}
+	return w.delete(id)
 }
 
-func (w *wallet) Update(id string, i interface{}) error {
+func (w *wallet) delete(id string) error {
 	eid, err := encryptSearcheable(w.metadata.NameKey, w.metadata.HmacKey, []byte(id))
 	if err != nil {
 		return err
 	}
+	if strings.HasPrefix(id, "_local/") {
+		w.keys.remove(strings.TrimPrefix(id, "_local/"))
+	}
+	return w.storage.Delete(w.ctx, eid)
+}
+
+func (w *wallet) Search(typ string, q Query) ([]Record, error) {
+	if err := w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	if typ == "" || strings.HasPrefix(typ, "_local/") || isAuditRecord(typ) {
+		return nil, errors.New("invalid record type")
+	}
+
+	etyp, err := encryptSearcheable(w.metadata.TypeKey, w.metadata.HmacKey, []byte(typ))
+	if err != nil {
+		return nil, err
+	}
+
+	cq, err := w.compileQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := w.storage.Search(w.ctx, etyp, cq)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0, len(items))
+	for _, i := range items {
+		r, err := w.decryptRecord(i)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(r.ID, "_local/") || isAuditRecord(r.ID) {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+func (w *wallet) List(typ string, cursor string, limit int) ([]Record, string, error) {
+	if err := w.rlock(); err != nil {
+		return nil, "", err
+	}
+	defer w.mu.RUnlock()
+
+	if typ == "" || strings.HasPrefix(typ, "_local/") || isAuditRecord(typ) {
+		return nil, "", errors.New("invalid record type")
+	}
+	return w.list(typ, cursor, limit)
+}
+
+func (w *wallet) list(typ string, cursor string, limit int) ([]Record, string, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	etyp, err := encryptSearcheable(w.metadata.TypeKey, w.metadata.HmacKey, []byte(typ))
+	if err != nil {
+		return nil, "", err
+	}
+
+	items, next, err := w.storage.List(w.ctx, etyp, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	records := make([]Record, 0, len(items))
+	for _, i := range items {
+		r, err := w.decryptRecord(i)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, r)
+	}
+	return records, next, nil
+}
+
+func (w *wallet) Iterate(typ string) *RecordIterator {
+	return &RecordIterator{list: w.List, typ: typ}
+}
+
+func (w *wallet) encryptItem(id string, i interface{}, typ *string, tags Tags) (Item, error) {
+	eid, err := encryptSearcheable(w.metadata.NameKey, w.metadata.HmacKey, []byte(id))
+	if err != nil {
+		return Item{}, err
+	}
 
 	valueKey := make([]byte, chacha20poly1305.KeySize)
 	_, err = rand.Read(valueKey)
 	if err != nil {
-		return err
+		return Item{}, err
 	}
+	defer zero(valueKey)
 
 	m, err := json.Marshal(i)
 	if err != nil {
-		return err
+		return Item{}, err
 	}
+	defer zero(m)
 
 	eitem, err := encrypt(valueKey, m)
 	if err != nil {
-		return err
+		return Item{}, err
 	}
 
 	evalueKey, err := encrypt(w.metadata.ItemKeyKey, valueKey)
 	if err != nil {
-		return err
+		return Item{}, err
 	}
 
-	storageItem := item{
+	storageItem := Item{
 		ID:      eid,
-		Item:    eitem,
+		Value:   eitem,
 		ItemKey: evalueKey,
 	}
 
-	return w.storage.update(storageItem)
+	if typ != nil && *typ != "" {
+		storageItem.Type, err = encryptSearcheable(w.metadata.TypeKey, w.metadata.HmacKey, []byte(*typ))
+		if err != nil {
+			return Item{}, err
+		}
+	}
+
+	if len(tags) > 0 {
+		storageItem.Tags = make(map[string]string, len(tags))
+		for name, value := range tags {
+			ename, err := w.encryptTagName(name)
+			if err != nil {
+				return Item{}, err
+			}
+			storageItem.Tags[ename], err = w.encryptTagValue(name, value)
+			if err != nil {
+				return Item{}, err
+			}
+		}
+	}
+
+	return storageItem, nil
 }
 
-func (w *wallet) Delete(id string) error {
+func (w *wallet) decryptValue(storageItem Item) ([]byte, error) {
+	itemKey, err := w.decryptItemKey(storageItem)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(itemKey)
+
+	return decrypt(itemKey, storageItem.Value)
+}
+
+func (w *wallet) decryptItemKey(storageItem Item) ([]byte, error) {
+	itemKey, err := decrypt(w.metadata.ItemKeyKey, storageItem.ItemKey)
+	if err != nil && w.metadata.PreviousItemKeyKey != nil {
+		return decrypt(w.metadata.PreviousItemKeyKey, storageItem.ItemKey)
+	}
+	return itemKey, err
+}
+
+// decryptStoredRecord reads the record stored for id, including the private
+// records under "_local/".
+func (w *wallet) decryptStoredRecord(id string) (Record, error) {
 	eid, err := encryptSearcheable(w.metadata.NameKey, w.metadata.HmacKey, []byte(id))
 	if err != nil {
-		return err
+		return Record{}, err
 	}
-	return w.storage.delete(eid)
+
+	storageItem, err := w.storage.Read(w.ctx, eid)
+	if err != nil {
+		return Record{}, err
+	}
+
+	return w.decryptRecord(storageItem)
 }
 
-func (w *wallet) CreateKey(typ KeyType) (string, error) {
-	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+func (w *wallet) decryptRecord(storageItem Item) (Record, error) {
+	id, err := decryptSearcheable(w.metadata.NameKey, storageItem.ID)
 	if err != nil {
+		return Record{}, err
+	}
+
+	r := Record{ID: string(id), Revision: storageItem.Revision}
+
+	if storageItem.Type != "" {
+		typ, err := decryptSearcheable(w.metadata.TypeKey, storageItem.Type)
+		if err != nil {
+			return Record{}, err
+		}
+		r.Type = string(typ)
+	}
+
+	if len(storageItem.Tags) > 0 {
+		r.Tags = make(Tags, len(storageItem.Tags))
+		for ename, evalue := range storageItem.Tags {
+			name, err := decryptSearcheable(w.metadata.TagNameKey, ename)
+			if err != nil {
+				return Record{}, err
+			}
+			value := []byte(evalue)
+			if !isPlaintextTag(string(name)) {
+				if value, err = decryptSearcheable(w.metadata.TagValueKey, evalue); err != nil {
+					return Record{}, err
+				}
+			}
+			r.Tags[string(name)] = string(value)
+		}
+	}
+
+	r.Value, err = w.decryptValue(storageItem)
+	return r, err
+}
+
+func (w *wallet) encryptTagName(name string) (string, error) {
+	return encryptSearcheable(w.metadata.TagNameKey, w.metadata.HmacKey, []byte(name))
+}
+
+func (w *wallet) encryptTagValue(name, value string) (string, error) {
+	if isPlaintextTag(name) {
+		return value, nil
+	}
+	return encryptSearcheable(w.metadata.TagValueKey, w.metadata.HmacKey, []byte(value))
+}
+
+// CreateKey creates a key of the given type. Once the wallet has a master
+// seed, Ed25519 keys are derived from it rather than generated at random.
+func (w *wallet) CreateKey(typ KeyType, opts ...KeyOption) (string, error) {
+	if err := w.rlock(); err != nil {
 		return "", err
 	}
-	enc := base58.Encode(pk)
-	err = w.Create("_local/"+enc, sk)
-	return enc, err
+	defer w.mu.RUnlock()
+
+	if typ == Ed25519VerificationKey2018Type {
+		id, err := w.createDerivedKey(newKeyOptions(opts))
+		if err != ErrorNotFound {
+			return id, err
+		}
+	}
+
+	id, key, err := generateKey(typ)
+	if err != nil {
+		return "", err
+	}
+
+	return w.storeKey(id, key, newKeyOptions(opts))
+}
+
+// storeKey stores a new key with the metadata set by o. Keys from a seed may
+// already be in the wallet, in which case the stored key is the same one and
+// is kept along with its metadata. The key is wiped once it is stored.
+func (w *wallet) storeKey(id string, key *keyRecord, o keyOptions) (_ string, err error) {
+	defer w.audit(AuditCreateKey, id, &err)
+
+	err = w.storeNewKey(id, key, o)
+	if err == ErrorAlreadyExists {
+		err = nil
+	}
+	return id, err
 }
 
-func (w *wallet) DeleteKey(id string) error {
-	return w.Delete("_local/" + id)
+// storeNewKey stores a key like storeKey, but fails with ErrorAlreadyExists
+// if the wallet holds it already.
+func (w *wallet) storeNewKey(id string, key *keyRecord, o keyOptions) error {
+	defer key.zero()
+
+	o.apply(key)
+	key.Created = time.Now().Unix()
+	return w.create("_local/"+id, key, WithType(keyRecordType))
+}
+
+func (w *wallet) DeleteKey(id string) (err error) {
+	if err = w.rlock(); err != nil {
+		return err
+	}
+	defer w.mu.RUnlock()
+	defer w.audit(AuditDeleteKey, id, &err)
+
+	var key keyRecord
+	if _, err = w.readKeyRecord(id, &key); err != nil {
+		return err
+	}
+	key.zero()
+	return w.delete("_local/" + id)
 }
 
 func (w *wallet) KeyExists(id string) bool {
-	if err := w.read("_local/"+id, &ed25519.PrivateKey{}); err != nil {
+	if w.rlock() != nil {
 		return false
 	}
+	defer w.mu.RUnlock()
+
+	key, err := w.readKey(id)
+	if err != nil {
+		return false
+	}
+	w.releaseKey(key)
 	return true
 }
 
-func (w *wallet) Encrypt(id string, data []byte) (ciphertext []byte, err error) {
-	panic("not implemented")
+func (w *wallet) ListKeys(cursor string, limit int) ([]KeyInfo, string, error) {
+	if err := w.rlock(); err != nil {
+		return nil, "", err
+	}
+	defer w.mu.RUnlock()
+
+	records, next, err := w.list(keyRecordType, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer func() {
+		for _, r := range records {
+			zero(r.Value)
+		}
+	}()
+
+	keys := make([]KeyInfo, 0, len(records))
+	for _, r := range records {
+		var key keyRecord
+		if err := json.Unmarshal(r.Value, &key); err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key.info(strings.TrimPrefix(r.ID, "_local/")))
+		key.zero()
+	}
+	return keys, next, nil
+}
+
+func (w *wallet) readKey(id string) (*keyRecord, error) {
+	if key := w.keys.get(id); key != nil {
+		return key, nil
+	}
+
+	var key keyRecord
+	if _, err := w.readKeyRecord(id, &key); err != nil {
+		return nil, err
+	}
+	w.keys.put(id, &key)
+	return &key, nil
+}
+
+// readKeyRecord reads the key id from storage into key, and returns its
+// revision. It fails with ErrorNotFound for the ids of the other private
+// records under "_local/", which all have a '/' and a type other than
+// keyRecordType. Keys stored before keys had a type have none.
+func (w *wallet) readKeyRecord(id string, key *keyRecord) (string, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return "", ErrorNotFound
+	}
+
+	r, err := w.decryptStoredRecord("_local/" + id)
+	if err != nil {
+		return "", err
+	}
+	defer zero(r.Value)
+	if r.Type != keyRecordType && r.Type != "" {
+		return "", ErrorNotFound
+	}
+	return r.Revision, json.Unmarshal(r.Value, key)
+}
+
+func (w *wallet) Encrypt(id string, data []byte, additionalData []byte) (ciphertext []byte, err error) {
+	if err = w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	key, err := w.useKey(id, KeyUsageEncrypt)
+	if err != nil {
+		return nil, err
+	}
+	defer w.releaseKey(key)
+	if key.Type != XChaCha20Poly1305KeyType {
+		return nil, ErrorInvalidKeyType
+	}
+	if key.ReplacedBy != "" {
+		return nil, ErrorKeyRetired
+	}
+
+	aead, err := chacha20poly1305.NewX(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(data)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, additionalData), nil
 }
 
-func (w *wallet) Decrypt(id string, ciphertext []byte) (data []byte, err error) {
-	panic("not implemented")
+func (w *wallet) Decrypt(id string, ciphertext []byte, additionalData []byte) (data []byte, err error) {
+	if err = w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+
+	key, err := w.useKey(id, KeyUsageEncrypt)
+	if err != nil {
+		return nil, err
+	}
+	defer w.releaseKey(key)
+	if key.Type != XChaCha20Poly1305KeyType {
+		return nil, ErrorInvalidKeyType
+	}
+
+	aead, err := chacha20poly1305.NewX(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < chacha20poly1305.NonceSizeX+aead.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return aead.Open(nil, ciphertext[:chacha20poly1305.NonceSizeX], ciphertext[chacha20poly1305.NonceSizeX:], additionalData)
 }
 
-func (w *wallet) Sign(id string, data []byte) ([]byte, error) {
-	var sk ed25519.PrivateKey
-	err := w.read("_local/"+id, &sk)
+func (w *wallet) Sign(id string, data []byte) (sig []byte, err error) {
+	if err = w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
+	defer w.audit(AuditSign, id, &err)
+
+	key, err := w.useKey(id, KeyUsageSign)
 	if err != nil {
 		return nil, err
 	}
-	return ed25519.Sign(sk, data), nil
+	defer w.releaseKey(key)
+	if key.ReplacedBy != "" {
+		return nil, ErrorKeyRetired
+	}
+	return key.sign(data)
 }
 
+// Verify checks a signature made by the key id, which does not need to be
+// held by the wallet: ids of other keys are parsed as base58 Ed25519 verkeys
+// or multibase encoded keys. Use PublicKey to verify signatures of other key
+// types.
 func (w *wallet) Verify(id string, msg []byte, sig []byte) bool {
-	var sk ed25519.PrivateKey
-	err := w.read("_local/"+id, &sk)
+	if w.rlock() != nil {
+		return false
+	}
+	defer w.mu.RUnlock()
+
+	pk, err := w.publicKey(id)
 	if err != nil {
 		return false
 	}
-	return ed25519.Verify(sk.Public().(ed25519.PublicKey), msg, sig)
+	return pk.Verify(msg, sig)
 }
 
+// Seal encrypts message from senderKey to receiverKey. The receiver key is
+// taken to be of the same kind as the sender key: an Ed25519 verkey if the
+// sender key is an Ed25519 key, or an X25519 public key if it is an X25519
+// key.
 func (w *wallet) Seal(message []byte, receiverKey, senderKey string) (encrypted []byte, nonce [24]byte, err error) {
-	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+	if err = w.rlock(); err != nil {
 		return
 	}
+	defer w.mu.RUnlock()
+	defer w.audit(AuditSeal, senderKey, &err)
 
-	d := base58.Decode(receiverKey)
-	pk := new([32]byte)
-	copy(pk[:], d[:32])
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return
+	}
 
-	var curve25519pk [32]byte
-	extra25519.PublicKeyToCurve25519(&curve25519pk, pk)
+	var key *keyRecord
+	if key, err = w.useKey(senderKey, KeyUsageKeyAgreement); err != nil {
+		return
+	}
+	defer w.releaseKey(key)
+	if key.ReplacedBy != "" {
+		err = ErrorKeyRetired
+		return
+	}
 
-	var key ed25519.PrivateKey
-	if err = w.read("_local/"+senderKey, &key); err != nil {
+	var curve25519sk *[32]byte
+	if curve25519sk, err = key.curve25519PrivateKey(); err != nil {
 		return
 	}
-	sk := new([64]byte)
-	copy(sk[:], key[:64])
 
-	var curve25519sk [32]byte
-	extra25519.PrivateKeyToCurve25519(&curve25519sk, sk)
+	var curve25519pk *[32]byte
+	if curve25519pk, err = curve25519PublicKey(key.Type, receiverKey); err != nil {
+		return
+	}
 
-	encrypted = box.Seal([]byte{}, message, &nonce, &curve25519pk, &curve25519sk)
+	encrypted = box.Seal([]byte{}, message, &nonce, curve25519pk, curve25519sk)
 	return
 }
 
 func (w *wallet) Open(ciphertext []byte, nonce []byte, senderKey, receiverKey string) (plaintext []byte, res bool) {
-	var key ed25519.PrivateKey
-	if err := w.read("_local/"+receiverKey, &key); err != nil {
+	if w.rlock() != nil {
 		return nil, false
 	}
-	sk := new([64]byte)
-	copy(sk[:], key[:64])
+	defer w.mu.RUnlock()
+	defer w.auditOpen(receiverKey, &plaintext, &res)
 
-	var curve25519sk [32]byte
-	extra25519.PrivateKeyToCurve25519(&curve25519sk, sk)
+	key, err := w.checkKey(receiverKey, KeyUsageKeyAgreement)
+	if err != nil {
+		return nil, false
+	}
+	defer w.releaseKey(key)
 
-	d := base58.Decode(senderKey)
-	pk := new([32]byte)
-	copy(pk[:], d[:32])
+	curve25519sk, err := key.curve25519PrivateKey()
+	if err != nil {
+		return nil, false
+	}
 
-	var curve25519pk [32]byte
-	extra25519.PublicKeyToCurve25519(&curve25519pk, pk)
+	curve25519pk, err := curve25519PublicKey(key.Type, senderKey)
+	if err != nil {
+		return nil, false
+	}
 
+	if len(nonce) < chacha20poly1305.NonceSizeX {
+		return nil, false
+	}
 	n := new([chacha20poly1305.NonceSizeX]byte)
 	copy(n[:], nonce[:chacha20poly1305.NonceSizeX])
 
-	return box.Open([]byte{}, ciphertext, n, &curve25519pk, &curve25519sk)
+	if plaintext, res = box.Open([]byte{}, ciphertext, n, curve25519pk, curve25519sk); res {
+		res = w.chargeOpen(receiverKey, key, plaintext)
+	}
+	if !res {
+		return nil, false
+	}
+	return plaintext, true
 }
 
+// SealAnonymous encrypts message to receiverKey, which is taken to be an
+// Ed25519 verkey unless the wallet holds it as an X25519 key.
 func (w *wallet) SealAnonymous(message []byte, receiverKey string) (encrypted []byte, err error) {
-	d := base58.Decode(receiverKey)
-	pk := new([32]byte)
-	copy(pk[:], d[:32])
+	if err = w.rlock(); err != nil {
+		return nil, err
+	}
+	defer w.mu.RUnlock()
 
-	var curve25519pk [32]byte
-	extra25519.PublicKeyToCurve25519(&curve25519pk, pk)
+	typ := Ed25519VerificationKey2018Type
+	if key, err := w.readKey(receiverKey); err == nil {
+		typ = key.Type
+		w.releaseKey(key)
+	}
 
-	return box.SealAnonymous([]byte{}, message, &curve25519pk, rand.Reader)
+	curve25519pk, err := curve25519PublicKey(typ, receiverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return box.SealAnonymous([]byte{}, message, curve25519pk, rand.Reader)
 }
 
 func (w *wallet) OpenAnonymous(ciphertext []byte, receiverKey string) (plaintext []byte, res bool) {
-	var key ed25519.PrivateKey
-	if err := w.read("_local/"+receiverKey, &key); err != nil {
+	if w.rlock() != nil {
+		return nil, false
+	}
+	defer w.mu.RUnlock()
+	defer w.auditOpen(receiverKey, &plaintext, &res)
+
+	key, err := w.checkKey(receiverKey, KeyUsageKeyAgreement)
+	if err != nil {
 		return nil, false
 	}
-	sk := new([64]byte)
-	copy(sk[:], key[:64])
+	defer w.releaseKey(key)
 
-	var curve25519sk [32]byte
-	extra25519.PrivateKeyToCurve25519(&curve25519sk, sk)
+	curve25519sk, err := key.curve25519PrivateKey()
+	if err != nil {
+		return nil, false
+	}
+
+	curve25519pk, err := curve25519PublicKey(key.Type, receiverKey)
+	if err != nil {
+		return nil, false
+	}
+
+	if plaintext, res = box.OpenAnonymous([]byte{}, ciphertext, curve25519pk, curve25519sk); res {
+		res = w.chargeOpen(receiverKey, key, plaintext)
+	}
+	if !res {
+		return nil, false
+	}
+	return plaintext, true
+}
 
-	d := base58.Decode(receiverKey)
-	pk := new([32]byte)
-	copy(pk[:], d[:32])
+// storedMetadata is the value of the metadata item: the key derivation
+// parameters and the metadata encrypted with the derived master key, or the
+// metadata wrapped by a Wrapper. Wallets created before the key derivation
+// parameters were stored hold only the encrypted metadata.
+type storedMetadata struct {
+	KDF      kdfParams `json:"kdf"`
+	Wrapped  bool      `json:"wrapped,omitempty"`
+	Metadata string    `json:"metadata"`
+}
+
+func readStoredMetadata(m Item) (storedMetadata, error) {
+	if !strings.HasPrefix(m.Value, "{") {
+		return storedMetadata{KDF: legacyKDFParams(), Metadata: m.Value}, nil
+	}
+
+	var stored storedMetadata
+	if err := json.Unmarshal([]byte(m.Value), &stored); err != nil {
+		return storedMetadata{}, err
+	}
+	if !stored.Wrapped {
+		if err := stored.KDF.validate(); err != nil {
+			return storedMetadata{}, err
+		}
+	}
+	return stored, nil
+}
+
+func decryptMetadata(m Item, password string) (*metadata, kdfParams, error) {
+	stored, err := readStoredMetadata(m)
+	if err != nil {
+		return nil, kdfParams{}, err
+	}
+	if stored.Wrapped {
+		return nil, kdfParams{}, errors.New("wallet metadata is wrapped, open the wallet with NewWalletWithWrapper")
+	}
+
+	key, err := stored.KDF.deriveKey(password)
+	if err != nil {
+		return nil, kdfParams{}, err
+	}
+	defer zero(key)
+
+	b, err := decrypt(key, stored.Metadata)
+	if err != nil {
+		return nil, kdfParams{}, ErrorInvalidPassword
+	}
+	defer zero(b)
+	var metadata metadata
+	err = json.Unmarshal(b, &metadata)
+	return &metadata, stored.KDF, err
+}
+
+func encryptMetadata(metadata *metadata, key []byte, params kdfParams) (string, error) {
+	plaintext, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	defer zero(plaintext)
 
-	var curve25519pk [32]byte
-	extra25519.PublicKeyToCurve25519(&curve25519pk, pk)
+	ciphertext, err := encrypt(key, plaintext)
+	if err != nil {
+		return "", err
+	}
 
-	return box.OpenAnonymous([]byte{}, ciphertext, &curve25519pk, &curve25519sk)
+	stored, err := json.Marshal(storedMetadata{KDF: params, Metadata: ciphertext})
+	return string(stored), err
 }
 
-func decryptMetadata(m item, key []byte) (*metadata, error) {
-	b, err := decrypt(key, m.Item)
+func unwrapMetadata(m Item, wrapper Wrapper) (*metadata, error) {
+	stored, err := readStoredMetadata(m)
+	if err != nil {
+		return nil, err
+	}
+	if !stored.Wrapped {
+		return nil, errors.New("wallet metadata is not wrapped, open the wallet with NewWallet")
+	}
+
+	wrapped, err := base64.URLEncoding.DecodeString(stored.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := wrapper.Unwrap(wrapped)
 	if err != nil {
 		return nil, err
 	}
+	defer zero(b)
 	var metadata metadata
 	err = json.Unmarshal(b, &metadata)
 	return &metadata, err
 }
 
-func generateMetadata(key []byte, s Storage) (*metadata, error) {
+func wrapMetadata(metadata *metadata, wrapper Wrapper) (string, error) {
+	plaintext, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+	defer zero(plaintext)
+
+	wrapped, err := wrapper.Wrap(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	stored, err := json.Marshal(storedMetadata{Wrapped: true, Metadata: base64.URLEncoding.EncodeToString(wrapped)})
+	return string(stored), err
+}
+
+func newMetadata() (*metadata, error) {
 	metadata := metadata{
 		TagNameKey:  make([]byte, chacha20poly1305.KeySize),
 		TagValueKey: make([]byte, chacha20poly1305.KeySize),
@@ -359,23 +1092,7 @@ func generateMetadata(key []byte, s Storage) (*metadata, error) {
 		return nil, err
 	}
 
-	plaintext, err := json.Marshal(metadata)
-	if err != nil {
-		return nil, err
-	}
-
-	ciphertext, err := encrypt(key, plaintext)
-	if err != nil {
-		return nil, err
-	}
-
-	storageItem := item{
-		ID:   "metadata",
-		Item: ciphertext,
-	}
-
-	err = s.create(storageItem)
-	return &metadata, err
+	return &metadata, nil
 }
 
 func encrypt(key []byte, plaintext []byte) (string, error) {
@@ -408,6 +1125,23 @@ func encryptSearcheable(key []byte, hmacKey []byte, plaintext []byte) (string, e
 	return base64.URLEncoding.EncodeToString(append(nonce, ciphertext...)), nil
 }
 
+func decryptSearcheable(key []byte, ciphertext string) ([]byte, error) {
+	decodedCiphertext, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(decodedCiphertext) < 64 {
+		return nil, errors.New("invalid ciphertext")
+	}
+
+	name, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return name.Open(nil, decodedCiphertext[:chacha20poly1305.NonceSizeX], decodedCiphertext[64:], nil)
+}
+
 func decrypt(key []byte, ciphertext string) ([]byte, error) {
 	decodedCiphertext, err := base64.URLEncoding.DecodeString(ciphertext)
 	if err != nil {
@@ -1,16 +1,39 @@
 package wallet
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
+	"crypto/sha512"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcutil/base58"
 	"github.com/go-resty/resty/v2"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testObj struct {
 	A string `json:"a"`
 }
 
+func mustEncryptSearcheable(t *testing.T, w Wallet, typ string) string {
+	e, err := encryptSearcheable(w.(*wallet).metadata.TypeKey, w.(*wallet).metadata.HmacKey, []byte(typ))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return e
+}
+
 type TestStorage struct {
 	Name     string
 	Setup    func() Storage
@@ -24,22 +47,59 @@ func TestSuite(t *testing.T) {
 	ims.Setup = func() Storage { return NewInMemoryStorage() }
 	ims.Teardown = func() {}
 
+	// Run against the CouchDB server at COUCHDB_URL if set, otherwise
+	// against a stand-in of its API.
+	couchURL := os.Getenv("COUCHDB_URL")
+	if couchURL == "" {
+		_, srv := newFakeCouchDB("", "")
+		defer srv.Close()
+		couchURL = srv.URL
+	}
+
 	cdb := TestStorage{}
 	cdb.Name = "CouchDB"
 	cdb.Setup = func() Storage {
-		c, err := NewCouchDbStorage("test")
+		cdb.Teardown()
+		c, err := NewCouchDbStorage("test", WithCouchDBURL(couchURL))
 		if err != nil {
 			t.Fatalf(err.Error())
 		}
 		return c
 	}
 	cdb.Teardown = func() {
-		resty.New().R().Delete("http://localhost:5984/test")
+		resty.New().R().Delete(couchURL + "/test")
+	}
+
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var bs Storage
+	bdb := TestStorage{}
+	bdb.Name = "Bolt"
+	bdb.Setup = func() Storage {
+		bdb.Teardown()
+		s, err := NewBoltStorage(filepath.Join(dir, "wallet.db"))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		bs = s
+		return s
+	}
+	bdb.Teardown = func() {
+		if bs != nil {
+			bs.Close()
+			bs = nil
+		}
+		os.Remove(filepath.Join(dir, "wallet.db"))
 	}
 
 	for _, db := range []TestStorage{
 		ims,
-		//cdb,
+		bdb,
+		cdb,
 	} {
 
 		t.Run(db.Name, func(t *testing.T) {
@@ -214,6 +274,2438 @@ func TestSuite(t *testing.T) {
 			})
 
 			db.Teardown()
+
+			t.Run("TestEncryptDecrypt", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				kid, err := w.CreateKey(XChaCha20Poly1305KeyType)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				ciphertext, err := w.Encrypt(kid, []byte("secret"), []byte("context"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				plaintext, err := w.Decrypt(kid, ciphertext, []byte("context"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if string(plaintext) != "secret" {
+					t.Fatalf("Expected: %s, Actual: %s", "secret", plaintext)
+				}
+
+				_, err = w.Decrypt(kid, ciphertext, []byte("other context"))
+				if err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestWrongKeyType", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				skid, err := w.CreateKey(XChaCha20Poly1305KeyType)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				_, err = w.Encrypt(kid, []byte("secret"), nil)
+				if err != ErrorInvalidKeyType {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidKeyType, err)
+				}
+				_, err = w.Sign(skid, []byte("message"))
+				if err != ErrorInvalidKeyType {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidKeyType, err)
+				}
+				_, err = w.CreateKey("unknown")
+				if err != ErrorInvalidKeyType {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidKeyType, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestLegacyKeyRecord", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				pk, sk, err := ed25519.GenerateKey(nil)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				kid := base58.Encode(pk)
+				err = w.Create("_local/"+kid, sk)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				sig, err := w.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !ed25519.Verify(pk, []byte("message"), sig) {
+					t.Fatalf("Signature did not validate")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestSearchByTags", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				records := []struct {
+					id   string
+					tags Tags
+				}{
+					{"conn1", Tags{"state": "active", "thid": "1", "~created": "2020-01-01"}},
+					{"conn2", Tags{"state": "active", "thid": "2", "~created": "2020-02-01"}},
+					{"conn3", Tags{"state": "invited", "thid": "3", "~created": "2020-03-01"}},
+				}
+				for _, r := range records {
+					err = w.Create(r.id, testObj{A: r.id}, WithType("connection"), WithTags(r.tags))
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				err = w.Create("cred1", testObj{A: "cred1"}, WithType("credential"), WithTags(Tags{"state": "active"}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				for _, tc := range []struct {
+					query    Query
+					expected []string
+				}{
+					{Query{}, []string{"conn1", "conn2", "conn3"}},
+					{Query{"state": "active"}, []string{"conn1", "conn2"}},
+					{Query{"state": "active", "thid": "2"}, []string{"conn2"}},
+					{Query{"state": Query{"$neq": "active"}}, []string{"conn3"}},
+					{Query{"thid": Query{"$in": []string{"1", "3"}}}, []string{"conn1", "conn3"}},
+					{Query{"$or": []Query{{"thid": "1"}, {"state": "invited"}}}, []string{"conn1", "conn3"}},
+					{Query{"$not": Query{"thid": "1"}}, []string{"conn2", "conn3"}},
+					{Query{"~created": Query{"$gte": "2020-02-01"}}, []string{"conn2", "conn3"}},
+					{Query{"state": "unknown"}, []string{}},
+				} {
+					result, err := w.Search("connection", tc.query)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+
+					ids := make([]string, 0)
+					for _, r := range result {
+						var o testObj
+						if err = json.Unmarshal(r.Value, &o); err != nil {
+							t.Fatal(err.Error())
+						}
+						if o.A != r.ID || r.Type != "connection" {
+							t.Fatalf("Unexpected record: %v", r)
+						}
+						ids = append(ids, r.ID)
+					}
+					sort.Strings(ids)
+					if !reflect.DeepEqual(ids, tc.expected) {
+						t.Fatalf("Query: %v, Expected: %s, Actual: %s", tc.query, tc.expected, ids)
+					}
+				}
+
+				_, err = w.Search("connection", Query{"state": Query{"$gt": "a"}})
+				if err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestTagsAreEncrypted", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				err = w.Create("conn1", testObj{A: "b"}, WithType("connection"), WithTags(Tags{"state": "active", "~sort": "1"}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				result, err := s.Search(context.Background(), mustEncryptSearcheable(t, w, "connection"), StorageQuery{Op: QueryAnd})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(result) != 1 {
+					t.Fatalf("Expected: 1 item, Actual: %d", len(result))
+				}
+				for name, value := range result[0].Tags {
+					if name == "state" || name == "~sort" || value == "active" {
+						t.Fatalf("Tag stored in plaintext: %s=%s", name, value)
+					}
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestUpdateKeepsTags", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				err = w.Create("conn1", testObj{A: "b"}, WithType("connection"), WithTags(Tags{"state": "active"}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				err = w.Update("conn1", testObj{A: "c"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				result, err := w.Search("connection", Query{"state": "active"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(result) != 1 {
+					t.Fatalf("Expected: 1 record, Actual: %d", len(result))
+				}
+
+				err = w.Update("conn1", testObj{A: "c"}, WithTags(Tags{"state": "completed"}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				result, err = w.Search("connection", Query{"state": "active"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(result) != 0 {
+					t.Fatalf("Expected: 0 records, Actual: %d", len(result))
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestListRecordsByType", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				expected := make([]string, 0)
+				for i := 0; i < 25; i++ {
+					id := fmt.Sprintf("cred%02d", i)
+					expected = append(expected, id)
+					if err = w.Create(id, testObj{A: id}, WithType("credential")); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				if err = w.Create("conn1", testObj{A: "conn1"}, WithType("connection")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.CreateKey(Ed25519VerificationKey2018Type); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				ids := make([]string, 0)
+				cursor := ""
+				for {
+					records, next, err := w.List("credential", cursor, 10)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if len(records) > 10 {
+						t.Fatalf("Expected at most 10 records, Actual: %d", len(records))
+					}
+					for _, r := range records {
+						ids = append(ids, r.ID)
+					}
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				sort.Strings(ids)
+				if !reflect.DeepEqual(ids, expected) {
+					t.Fatalf("Expected: %s, Actual: %s", expected, ids)
+				}
+
+				ids = make([]string, 0)
+				it := w.Iterate("credential")
+				for it.Next() {
+					ids = append(ids, it.Record().ID)
+				}
+				if err = it.Err(); err != nil {
+					t.Fatal(err.Error())
+				}
+				sort.Strings(ids)
+				if !reflect.DeepEqual(ids, expected) {
+					t.Fatalf("Expected: %s, Actual: %s", expected, ids)
+				}
+
+				_, _, err = w.List(keyRecordType, "", 10)
+				if err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestStorageContract", func(t *testing.T) {
+				s := db.Setup()
+				ctx := context.Background()
+
+				if err := s.Delete(ctx, "missing"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				for _, id := range []string{"a", "b", "c"} {
+					if err := s.Create(ctx, Item{ID: id, Type: "test", Value: id}); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				if err := s.Delete(ctx, "b"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err := s.Delete(ctx, "b"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+
+				// A limit of zero or less lists a page of the default size
+				for _, limit := range []int{0, -1} {
+					items, next, err := s.List(ctx, "test", "", limit)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if len(items) != 2 || next != "" {
+						t.Fatalf("Expected 2 items and no next page, Actual: %d, %q", len(items), next)
+					}
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestListKeys", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				skid, err := w.CreateKey(XChaCha20Poly1305KeyType)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("conn1", testObj{A: "conn1"}, WithType("connection")); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				keys, next, err := w.ListKeys("", 10)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if next != "" {
+					t.Fatalf("Expected no further page, Actual: %s", next)
+				}
+				found := make(map[string]KeyType)
+				for _, k := range keys {
+					found[k.ID] = k.Type
+				}
+				expected := map[string]KeyType{kid: Ed25519VerificationKey2018Type, skid: XChaCha20Poly1305KeyType}
+				if !reflect.DeepEqual(found, expected) {
+					t.Fatalf("Expected: %v, Actual: %v", expected, found)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestWalletsHaveDistinctSalts", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				other, err := NewWallet("supersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				params, otherParams := w.(*wallet).kdf, other.(*wallet).kdf
+				if params.Method != KeyDerivationArgon2id {
+					t.Fatalf("Expected: %s, Actual: %s", KeyDerivationArgon2id, params.Method)
+				}
+				if len(params.Salt) != saltSize || reflect.DeepEqual(params.Salt, otherParams.Salt) {
+					t.Fatalf("Expected distinct random salts, Actual: %x, %x", params.Salt, otherParams.Salt)
+				}
+
+				_, err = NewWallet("wrongpassword", s)
+				if err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidPassword, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestKeyDerivationMethods", func(t *testing.T) {
+				rawKey, err := GenerateRawKey()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				for method, password := range map[KeyDerivation]string{
+					KeyDerivationPBKDF2: "supersecret",
+					KeyDerivationRaw:    rawKey,
+				} {
+					s := db.Setup()
+					w, err := NewWallet(password, s, WithKeyDerivation(method))
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = w.Create("uniqueid", testObj{A: "b"}); err != nil {
+						t.Fatal(err.Error())
+					}
+
+					w, err = NewWallet(password, s)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if w.(*wallet).kdf.Method != method {
+						t.Fatalf("Expected: %s, Actual: %s", method, w.(*wallet).kdf.Method)
+					}
+
+					var output testObj
+					if err = w.Read("uniqueid", &output); err != nil {
+						t.Fatal(err.Error())
+					}
+					db.Teardown()
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestOpenLegacyWallet", func(t *testing.T) {
+				s := db.Setup()
+
+				// Wallets used to store the metadata encrypted under a master
+				// key derived with a fixed salt
+				metadata := &metadata{
+					TagNameKey:  make([]byte, 32),
+					TagValueKey: make([]byte, 32),
+					HmacKey:     make([]byte, 64),
+					TypeKey:     make([]byte, 32),
+					NameKey:     make([]byte, 32),
+					ItemKeyKey:  make([]byte, 32),
+				}
+				plaintext, err := json.Marshal(metadata)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				masterKey := pbkdf2.Key([]byte("supersecret"), []byte("saltsaltsaltsalt"), 100000, 32, sha512.New)
+				ciphertext, err := encrypt(masterKey, plaintext)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = s.Create(context.Background(), Item{ID: metadataId, Value: ciphertext}); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !reflect.DeepEqual(w.(*wallet).metadata, metadata) {
+					t.Fatal("Metadata of the legacy wallet was not recovered")
+				}
+
+				_, err = NewWallet("wrongpassword", s)
+				if err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidPassword, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestTamperedKDFParams", func(t *testing.T) {
+				s := db.Setup()
+				if _, err := NewWallet("supersecret", s); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// The parameters are stored in plaintext, and must not crash
+				// or stall the process when changed
+				for _, tamper := range []func(p *kdfParams){
+					func(p *kdfParams) { p.Iterations = 0 },
+					func(p *kdfParams) { p.Threads = 0 },
+					func(p *kdfParams) { p.Memory = 1 << 31 },
+					func(p *kdfParams) { p.Method = "scrypt" },
+				} {
+					m, err := s.Read(context.Background(), metadataId)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					original := m.Value
+
+					var stored storedMetadata
+					if err = json.Unmarshal([]byte(m.Value), &stored); err != nil {
+						t.Fatal(err.Error())
+					}
+					tamper(&stored.KDF)
+					b, err := json.Marshal(stored)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					m.Value = string(b)
+					if err = s.Update(context.Background(), m); err != nil {
+						t.Fatal(err.Error())
+					}
+
+					if _, err = NewWallet("supersecret", s); err == nil {
+						t.Fatal("Expected an error")
+					}
+
+					if m, err = s.Read(context.Background(), metadataId); err != nil {
+						t.Fatal(err.Error())
+					}
+					m.Value = original
+					if err = s.Update(context.Background(), m); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+
+				if _, err := NewWallet("supersecret", s); err != nil {
+					t.Fatal(err.Error())
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestRekey", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				input := testObj{A: "b"}
+				if err = w.Create("uniqueid", input); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				err = w.Rekey("wrongpassword", "newsecret")
+				if err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidPassword, err)
+				}
+
+				if err = w.Rekey("supersecret", "newsecret"); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				_, err = NewWallet("supersecret", s)
+				if err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidPassword, err)
+				}
+
+				w, err = NewWallet("newsecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				var output testObj
+				if err = w.Read("uniqueid", &output); err != nil {
+					t.Fatal(err.Error())
+				}
+				if output != input {
+					t.Fatalf("Expected: %s, Actual: %s", input, output)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestRekeyFull", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				input := testObj{A: "b"}
+				for i := 0; i < 5; i++ {
+					if err = w.Create(fmt.Sprintf("id%d", i), input); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				oldItemKeyKey := w.(*wallet).metadata.ItemKeyKey
+				if err = w.RekeyFull("supersecret", "newsecret"); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				w, err = NewWallet("newsecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				m := w.(*wallet).metadata
+				if reflect.DeepEqual(m.ItemKeyKey, oldItemKeyKey) || m.PreviousItemKeyKey != nil {
+					t.Fatal("Item key key was not rotated")
+				}
+
+				for i := 0; i < 5; i++ {
+					var output testObj
+					if err = w.Read(fmt.Sprintf("id%d", i), &output); err != nil {
+						t.Fatal(err.Error())
+					}
+					if output != input {
+						t.Fatalf("Expected: %s, Actual: %s", input, output)
+					}
+				}
+				if _, err = w.Sign(kid, []byte("message")); err != nil {
+					t.Fatal(err.Error())
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestWalletWithWrapper", func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wrapper")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer os.RemoveAll(dir)
+
+				wrapper, err := NewFileWrapper(filepath.Join(dir, "wrapping.key"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				s := db.Setup()
+				w, err := NewWalletWithWrapper(s, wrapper)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				input := testObj{A: "b"}
+				if err = w.Create("uniqueid", input); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// The wrapping key is loaded from the file
+				wrapper, err = NewFileWrapper(filepath.Join(dir, "wrapping.key"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				w, err = NewWalletWithWrapper(s, wrapper)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				var output testObj
+				if err = w.Read("uniqueid", &output); err != nil {
+					t.Fatal(err.Error())
+				}
+				if output != input {
+					t.Fatalf("Expected: %s, Actual: %s", input, output)
+				}
+
+				other, err := NewFileWrapper(filepath.Join(dir, "other.key"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = NewWalletWithWrapper(s, other); err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+				if _, err = NewWallet("supersecret", s); err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestSignatureKeyTypes", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				for _, typ := range []KeyType{
+					Ed25519VerificationKey2018Type,
+					EcdsaSecp256k1VerificationKey2019Type,
+					EcdsaSecp256r1VerificationKey2019Type,
+				} {
+					kid, err := w.CreateKey(typ)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+
+					sig, err := w.Sign(kid, []byte("message"))
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if !w.Verify(kid, []byte("message"), sig) {
+						t.Fatalf("%s signature did not validate", typ)
+					}
+					if w.Verify(kid, []byte("other message"), sig) {
+						t.Fatalf("%s signature validated for another message", typ)
+					}
+
+					_, _, err = w.Seal([]byte("message"), kid, kid)
+					if typ != Ed25519VerificationKey2018Type && err != ErrorInvalidKeyType {
+						t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidKeyType, err)
+					}
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestX25519KeyAgreement", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				alice, err := w.CreateKey(X25519KeyAgreementKey2019Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				bob, err := w.CreateKey(X25519KeyAgreementKey2019Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				encrypted, nonce, err := w.Seal([]byte("message"), bob, alice)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				plaintext, ok := w.Open(encrypted, nonce[:], alice, bob)
+				if !ok || string(plaintext) != "message" {
+					t.Fatal("Unable to open box")
+				}
+
+				encrypted, err = w.SealAnonymous([]byte("message"), bob)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				plaintext, ok = w.OpenAnonymous(encrypted, bob)
+				if !ok || string(plaintext) != "message" {
+					t.Fatal("Unable to open anonymous box")
+				}
+
+				_, err = w.Sign(alice, []byte("message"))
+				if err != ErrorInvalidKeyType {
+					t.Fatalf("Expected: %s, Actual: %s", ErrorInvalidKeyType, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestRecoverKeysFromSeedAndMnemonic", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				restored, err := NewWallet("supersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				mnemonic, err := NewMnemonic()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				for _, typ := range []KeyType{
+					Ed25519VerificationKey2018Type,
+					X25519KeyAgreementKey2019Type,
+					EcdsaSecp256k1VerificationKey2019Type,
+					EcdsaSecp256r1VerificationKey2019Type,
+				} {
+					kid, err := w.CreateKeyFromSeed(typ, []byte("00000000000000000000000000000My1"))
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					rkid, err := restored.CreateKeyFromSeed(typ, []byte("00000000000000000000000000000My1"))
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if kid != rkid {
+						t.Fatalf("Expected: %s, Actual: %s", kid, rkid)
+					}
+
+					kid, err = w.CreateKeyFromMnemonic(typ, mnemonic, "passphrase")
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					rkid, err = restored.CreateKeyFromMnemonic(typ, mnemonic, "passphrase")
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if kid != rkid {
+						t.Fatalf("Expected: %s, Actual: %s", kid, rkid)
+					}
+				}
+
+				_, err = w.CreateKeyFromSeed(Ed25519VerificationKey2018Type, []byte("short"))
+				if err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestHierarchicalDeterministicKeys", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				mnemonic, err := NewMnemonic()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				seed, err := MnemonicToSeed(mnemonic, "")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.SetMasterSeed(seed); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.SetMasterSeed(seed); err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+
+				created := make([]string, 0)
+				for i := 0; i < 3; i++ {
+					kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					created = append(created, kid)
+				}
+
+				keys, _, err := w.ListKeys("", 10)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				paths := make([]string, 0)
+				for _, k := range keys {
+					paths = append(paths, k.Path)
+				}
+				sort.Strings(paths)
+				if !reflect.DeepEqual(paths, []string{"m/0'/0'", "m/0'/1'", "m/0'/2'"}) {
+					t.Fatalf("Unexpected derivation paths: %s", paths)
+				}
+
+				// Restore the keys from the mnemonic in a new wallet
+				restored, err := NewWallet("supersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = restored.SetMasterSeed(seed); err != nil {
+					t.Fatal(err.Error())
+				}
+				ids, err := restored.RestoreDerivedKeys(2)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !reflect.DeepEqual(ids, created[:2]) {
+					t.Fatalf("Expected: %s, Actual: %s", created[:2], ids)
+				}
+				kid, err := restored.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if kid != created[2] {
+					t.Fatalf("Expected: %s, Actual: %s", created[2], kid)
+				}
+				kid, err = restored.DeriveKey(Ed25519VerificationKey2018Type, "m/0'/1'")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if kid != created[1] {
+					t.Fatalf("Expected: %s, Actual: %s", created[1], kid)
+				}
+
+				// Batches skip the indexes taken by DeriveKey too
+				taken, err := restored.DeriveKey(Ed25519VerificationKey2018Type, "m/0'/3'")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				batch, err := restored.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if kid, err = batch.CreateKey(Ed25519VerificationKey2018Type); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = batch.Commit(); err != nil {
+					t.Fatal(err.Error())
+				}
+				info, err := restored.ReadKeyInfo(kid)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if kid == taken || info.Path != "m/0'/4'" {
+					t.Fatalf("Expected a key at m/0'/4', Actual: %s at %s", kid, info.Path)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestMasterSeedIsNotAKey", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// Wallets used to keep the master seed among the keys
+				seed := []byte("0123456789abcdef0123456789abcdef")
+				if err = w.(*wallet).create(legacyMasterSeedId, masterSeed{Seed: seed, NextIndex: 3}, WithType(masterSeedRecordType)); err != nil {
+					t.Fatal(err.Error())
+				}
+				if w.KeyExists("masterseed") {
+					t.Fatal("Expected the master seed not to be a key")
+				}
+				if err = w.DeleteKey("masterseed"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				batch, err := w.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = batch.DeleteKey("masterseed"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+
+				// It is moved out of their way on first use
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				expected, _, err := deriveKeyRecord(Ed25519VerificationKey2018Type, seed, "m/0'/3'")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if kid != expected {
+					t.Fatalf("Expected: %s, Actual: %s", expected, kid)
+				}
+				if _, err = w.(*wallet).decryptStoredRecord(legacyMasterSeedId); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				if w.KeyExists("seed/master") || w.DeleteKey("seed/master") != ErrorNotFound {
+					t.Fatal("Expected the master seed not to be a key")
+				}
+				if err = w.SetMasterSeed(seed); err == nil {
+					t.Fatal("Expected an error, got nil.")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestVerifyCounterpartySignature", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				counterparty, err := NewWallet("supersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				kid, err := counterparty.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				sig, err := counterparty.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				if w.KeyExists(kid) {
+					t.Fatal("Key should not be held by the wallet")
+				}
+				if !w.Verify(kid, []byte("message"), sig) {
+					t.Fatal("Signature did not validate")
+				}
+				pk, err := ParsePublicKeyBase58(Ed25519VerificationKey2018Type, kid)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !w.Verify(pk.Multibase(), []byte("message"), sig) {
+					t.Fatal("Signature did not validate")
+				}
+				if w.Verify(kid, []byte("other message"), sig) {
+					t.Fatal("Signature validated for another message")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestBoltStorageLocked", func(t *testing.T) {
+				if db.Name != "Bolt" {
+					t.Skip()
+				}
+				db.Setup()
+				if _, err := NewBoltStorage(filepath.Join(dir, "wallet.db")); err != ErrorStorageLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorStorageLocked, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestCancelledContext", func(t *testing.T) {
+				s := db.Setup()
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				// Opening a wallet can be cancelled too
+				if _, err := NewWallet("password", s, WithOpenContext(ctx)); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+				if _, err := NewWalletWithWrapper(s, nil, WithOpenContext(ctx)); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+
+				w, err := NewWallet("password", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("test", "value"); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				cw := w.WithContext(ctx)
+
+				var value string
+				if err = cw.Read("test", &value); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+				if err = cw.Create("other", "value"); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+				if _, err = cw.CreateKey(Ed25519VerificationKey2018Type); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+				if err = w.Read("test", &value); err != nil {
+					t.Fatal(err.Error())
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestOptimisticConcurrency", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("password", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				if err = w.Create("connection", "invited", WithType("connection")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("connection", "invited"); err != ErrorAlreadyExists {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorAlreadyExists, err)
+				}
+
+				var state string
+				rev, err := w.ReadRevision("connection", &state)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Update("connection", "requested", WithRevision(rev)); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Update("connection", "responded", WithRevision(rev)); err != ErrorConflict {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorConflict, err)
+				}
+
+				records, err := w.Search("connection", Query{})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(records) != 1 || string(records[0].Value) != `"requested"` || records[0].Revision == rev {
+					t.Fatalf("Unexpected records: %v", records)
+				}
+				if err = w.Update("connection", "responded", WithRevision(records[0].Revision)); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// A writer that read before another one wrote is rejected
+				// by the storage itself
+				items, err := s.Search(context.Background(), mustEncryptSearcheable(t, w, "connection"), StorageQuery{Op: QueryAnd})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				stale := items[0]
+				if err = s.Update(context.Background(), stale); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = s.Update(context.Background(), stale); err != ErrorConflict {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorConflict, err)
+				}
+
+				if err = w.Update("missing", "value"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+
+				// Keys from the same seed can be created again
+				seed := make([]byte, SeedSize)
+				kid, err := w.CreateKeyFromSeed(Ed25519VerificationKey2018Type, seed)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if again, err := w.CreateKeyFromSeed(Ed25519VerificationKey2018Type, seed); err != nil || again != kid {
+					t.Fatalf("Expected: %s, Actual: %s (%v)", kid, again, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestBatch", func(t *testing.T) {
+				s := db.Setup()
+
+				// Storages without Batch get the changes one at a time
+				for _, storage := range []Storage{s, struct{ Storage }{s}} {
+					w, err := NewWallet("password", storage)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					for _, id := range []string{"a", "b", "c"} {
+						w.Delete(id)
+						if err = w.Create(id, id, WithType("test")); err != nil {
+							t.Fatal(err.Error())
+						}
+					}
+
+					batch, err := w.NewBatch()
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					kid, err := batch.CreateKey(Ed25519VerificationKey2018Type)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Create("d", "d", WithType("test")); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Update("a", "updated"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Delete("b"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if w.KeyExists(kid) {
+						t.Fatal("Key stored before commit")
+					}
+					if err = batch.Commit(); err != nil {
+						t.Fatal(err.Error())
+					}
+					if !w.KeyExists(kid) {
+						t.Fatal("Key not stored")
+					}
+
+					records, err := w.Search("test", Query{})
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					values := make(map[string]string)
+					for _, r := range records {
+						values[r.ID] = string(r.Value)
+					}
+					expected := map[string]string{"a": `"updated"`, "c": `"c"`, "d": `"d"`}
+					if !reflect.DeepEqual(values, expected) {
+						t.Fatalf("Expected: %v, Actual: %v", expected, values)
+					}
+
+					// A conflict found before writing
+					if batch, err = w.NewBatch(); err != nil {
+						t.Fatal(err.Error())
+					}
+					if kid, err = batch.CreateKey(Ed25519VerificationKey2018Type); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Create("e", "e", WithType("test")); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Delete("c"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Update("a", "lost"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = w.Update("a", "concurrent"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Commit(); !errors.Is(err, ErrorConflict) {
+						t.Fatalf("Expected: %v, Actual: %v", ErrorConflict, err)
+					}
+
+					// A conflict found while writing
+					if batch, err = w.NewBatch(); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Create("f", "f", WithType("test")); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Delete("c"); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Create("d", "d", WithType("test")); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = batch.Commit(); !errors.Is(err, ErrorAlreadyExists) {
+						t.Fatalf("Expected: %v, Actual: %v", ErrorAlreadyExists, err)
+					}
+
+					if w.KeyExists(kid) {
+						t.Fatal("Key of a failed batch stored")
+					}
+					records, err = w.Search("test", Query{})
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					values = make(map[string]string)
+					for _, r := range records {
+						values[r.ID] = string(r.Value)
+					}
+					expected = map[string]string{"a": `"concurrent"`, "c": `"c"`, "d": `"d"`}
+					if !reflect.DeepEqual(values, expected) {
+						t.Fatalf("Expected: %v, Actual: %v", expected, values)
+					}
+
+					w.Delete("d")
+					w.DeleteKey(kid)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestConcurrentUse", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("password", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				var wg sync.WaitGroup
+				errs := make(chan error, 100)
+				for i := 0; i < 20; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						id := fmt.Sprintf("record%d", i)
+						if err := w.Create(id, i, WithType("test"), WithTags(Tags{"n": id})); err != nil {
+							errs <- err
+							return
+						}
+						var value int
+						if err := w.Read(id, &value); err != nil {
+							errs <- err
+							return
+						}
+						if err := w.Update(id, value+1); err != nil {
+							errs <- err
+						}
+						if _, err := w.Search("test", Query{"n": id}); err != nil {
+							errs <- err
+						}
+						if sig, err := w.Sign(kid, []byte(id)); err != nil || !w.Verify(kid, []byte(id), sig) {
+							errs <- fmt.Errorf("signature failed: %v", err)
+						}
+					}(i)
+				}
+
+				// Rotating the keys waits for the other operations
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := w.RekeyFull("password", "new password"); err != nil {
+						errs <- err
+					}
+				}()
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					t.Fatal(err.Error())
+				}
+
+				w, err = NewWallet("new password", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for i := 0; i < 20; i++ {
+					var value int
+					if err = w.Read(fmt.Sprintf("record%d", i), &value); err != nil {
+						t.Fatal(err.Error())
+					}
+					if value != i+1 {
+						t.Fatalf("Expected: %d, Actual: %d", i+1, value)
+					}
+				}
+
+				// Keys derived concurrently from the master seed are distinct
+				if err = w.SetMasterSeed([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+					t.Fatal(err.Error())
+				}
+				ids := make(chan string, 10)
+				errs = make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						id, err := w.CreateKey(Ed25519VerificationKey2018Type)
+						if err != nil {
+							errs <- err
+							return
+						}
+						ids <- id
+					}()
+				}
+				wg.Wait()
+				close(ids)
+				close(errs)
+				for err := range errs {
+					t.Fatal(err.Error())
+				}
+				distinct := make(map[string]bool)
+				for id := range ids {
+					distinct[id] = true
+				}
+				if len(distinct) != 10 {
+					t.Fatalf("Expected: %d distinct keys, Actual: %d", 10, len(distinct))
+				}
+				ms, err := w.(*wallet).readMasterSeed()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if ms.NextIndex != 10 {
+					t.Fatalf("Expected: %d, Actual: %d", 10, ms.NextIndex)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestKeyCache", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s, WithKeyCache(2, time.Minute))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				cache := w.(*wallet).keys
+				now := time.Now()
+				cache.now = func() time.Time { return now }
+
+				var kids []string
+				for i := 0; i < 3; i++ {
+					kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if _, err = w.Sign(kid, []byte("message")); err != nil {
+						t.Fatal(err.Error())
+					}
+					kids = append(kids, kid)
+				}
+
+				// The least recently used key is evicted
+				if cache.get(kids[0]) != nil || cache.get(kids[1]) == nil || cache.get(kids[2]) == nil {
+					t.Fatal("Expected the two most recent keys to be cached")
+				}
+
+				// Cached keys keep their Curve25519 private key, so that
+				// opening messages does not convert them every time
+				if cache.get(kids[2]).agreementKey == nil {
+					t.Fatal("Expected the Curve25519 private key to be cached")
+				}
+
+				// Deleted keys cannot be used, even when cached
+				if err = w.DeleteKey(kids[1]); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(kids[1], []byte("message")); err == nil {
+					t.Fatal("Expected signing with a deleted key to fail")
+				}
+				b, err := w.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = b.DeleteKey(kids[2]); err != nil {
+					t.Fatal(err.Error())
+				}
+				if cache.get(kids[2]) == nil {
+					t.Fatal("Expected the key to stay cached until the batch is committed")
+				}
+				if err = b.Commit(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(kids[2], []byte("message")); err == nil {
+					t.Fatal("Expected signing with a deleted key to fail")
+				}
+
+				// Keys expire after the TTL
+				if _, err = w.Sign(kids[0], []byte("message")); err != nil {
+					t.Fatal(err.Error())
+				}
+				now = now.Add(2 * time.Minute)
+				if cache.get(kids[0]) != nil {
+					t.Fatal("Expected the key to have expired")
+				}
+				if _, err = w.Sign(kids[0], []byte("message")); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// Keys leaving the cache are wiped once no operation holds
+				// them
+				wiped := func(k *keyRecord) bool {
+					return bytes.Equal(k.Key, make([]byte, len(k.Key))) && *k.agreementKey == [32]byte{}
+				}
+				held := cache.get(kids[0])
+				for i := 0; i < 2; i++ {
+					kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if _, err = w.Sign(kid, []byte("message")); err != nil {
+						t.Fatal(err.Error())
+					}
+					kids = append(kids, kid)
+				}
+				if cache.get(kids[0]) != nil || wiped(held) {
+					t.Fatal("Expected the evicted key to be kept until released")
+				}
+				cache.release(held)
+				if !wiped(held) {
+					t.Fatal("Expected the evicted key to be wiped")
+				}
+				expired := cache.get(kids[4])
+				cache.release(expired)
+				now = now.Add(2 * time.Minute)
+				if cache.get(kids[4]) != nil || !wiped(expired) {
+					t.Fatal("Expected the expired key to be wiped")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestExportImport", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.SetMasterSeed([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("connection", testObj{A: "bob"}, WithType("connection"), WithTags(Tags{"name": "bob", "~state": "active"})); err != nil {
+					t.Fatal(err.Error())
+				}
+				// Spans several chunks
+				large := testObj{A: strings.Repeat("x", 5000)}
+				if err = w.Create("large", large); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				tmp, err := ioutil.TempDir("", "export")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer os.RemoveAll(tmp)
+				path := filepath.Join(tmp, "wallet.export")
+				if err = w.Export(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				restored, err := NewWallet("othersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = restored.Import(path, "wrongkey"); err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidPassword, err)
+				}
+				if err = restored.Import(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				records, err := restored.Search("connection", Query{"name": "bob", "~state": "active"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(records) != 1 || records[0].ID != "connection" {
+					t.Fatalf("Expected the imported connection, Actual: %v", records)
+				}
+				var obj testObj
+				if err = restored.Read("large", &obj); err != nil {
+					t.Fatal(err.Error())
+				}
+				if obj != large {
+					t.Fatal("Expected the large record to be restored")
+				}
+
+				// Keys and the master seed are carried over
+				sig, err := restored.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !w.Verify(kid, []byte("message"), sig) {
+					t.Fatal("Expected the restored key to sign like the original")
+				}
+				next, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				restoredNext, err := restored.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if next != restoredNext {
+					t.Fatalf("Expected: %s, Actual: %s", next, restoredNext)
+				}
+
+				// Records are not imported twice
+				if err = restored.Import(path, "exportkey"); err != ErrorAlreadyExists {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorAlreadyExists, err)
+				}
+
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for _, corrupted := range [][]byte{
+					data[:len(data)-10],
+					data[:len(data)-1024],
+					append(append([]byte(nil), data[:len(data)-1]...), data[len(data)-1]^1),
+				} {
+					if err = ioutil.WriteFile(path, corrupted, 0600); err != nil {
+						t.Fatal(err.Error())
+					}
+					empty, err := NewWallet("othersecret", NewInMemoryStorage())
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = empty.Import(path, "exportkey"); err != ErrorInvalidExport {
+						t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidExport, err)
+					}
+				}
+
+				// Headers that would crash the process or exhaust its memory
+				// are rejected before the key is derived
+				valid := exportHeader{
+					Version:       exportVersion,
+					KeyDerivation: kdfParams{Method: KeyDerivationArgon2id, Salt: make([]byte, 16), Iterations: 1, Memory: 1024, Threads: 1},
+					Nonce:         make([]byte, 12),
+					ChunkSize:     exportChunkSize,
+				}
+				forged := make([][]byte, 0)
+				for _, tamper := range []func(h *exportHeader){
+					func(h *exportHeader) { h.KeyDerivation.Iterations = 0 },
+					func(h *exportHeader) { h.KeyDerivation.Threads = 0 },
+					func(h *exportHeader) { h.KeyDerivation.Memory = 1 << 31 },
+					func(h *exportHeader) { h.KeyDerivation.Method = "scrypt" },
+					func(h *exportHeader) { h.ChunkSize = 1 << 30 },
+				} {
+					h := valid
+					tamper(&h)
+					header, err := json.Marshal(h)
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					n := len(header)
+					forged = append(forged, append([]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}, header...))
+				}
+				forged = append(forged, []byte{0xff, 0xff, 0xff, 0xff})
+				for _, data := range forged {
+					if err = ioutil.WriteFile(path, data, 0600); err != nil {
+						t.Fatal(err.Error())
+					}
+					empty, err := NewWallet("othersecret", NewInMemoryStorage())
+					if err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = empty.Import(path, "exportkey"); err != ErrorInvalidExport {
+						t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidExport, err)
+					}
+				}
+
+				// The plaintext of the records is wiped once encrypted
+				stream, err := newExportStream(make([]byte, 32), make([]byte, 12), 16)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				stream.w = ioutil.Discard
+				if err = stream.write(bytes.Repeat([]byte{0xff}, 20)); err != nil {
+					t.Fatal(err.Error())
+				}
+				buf := stream.buf[:cap(stream.buf)]
+				if err = stream.close(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if !bytes.Equal(buf, make([]byte, len(buf))) {
+					t.Fatal("Expected the buffer of the export to be wiped")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestMigrate", func(t *testing.T) {
+				s := db.Setup()
+				src := NewInMemoryStorage()
+				w, err := NewWallet("supersecret", src)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for i := 0; i < 5; i++ {
+					id := fmt.Sprintf("record%d", i)
+					if err = w.Create(id, testObj{A: id}, WithType("test"), WithTags(Tags{"n": id})); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+
+				// Interrupt the migration after the first page
+				ctx, cancel := context.WithCancel(context.Background())
+				smallPages := func(o *migrateOptions) { o.pageSize = 2 }
+				cursor := ""
+				err = Migrate(ctx, src, s, smallPages, WithMigrateProgress(func(next string, copied int) {
+					cursor = next
+					cancel()
+				}))
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+				if err = VerifyMigration(context.Background(), src, s); !errors.Is(err, ErrorMigrationMismatch) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorMigrationMismatch, err)
+				}
+
+				if err = Migrate(context.Background(), src, s, smallPages, WithMigrateCursor(cursor)); err != nil {
+					t.Fatal(err.Error())
+				}
+				// Running it again changes nothing
+				if err = Migrate(context.Background(), src, s); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				migrated, err := NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				records, err := migrated.Search("test", Query{"n": "record3"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(records) != 1 || records[0].ID != "record3" {
+					t.Fatalf("Expected record3, Actual: %v", records)
+				}
+				sig, err := migrated.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !w.Verify(kid, []byte("message"), sig) {
+					t.Fatal("Expected the migrated key to sign like the original")
+				}
+
+				// Items that differ are reported
+				if err = migrated.Update("record0", testObj{A: "changed"}); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = Migrate(context.Background(), src, s); !errors.Is(err, ErrorMigrationMismatch) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorMigrationMismatch, err)
+				}
+				dst := NewInMemoryStorage()
+				if err = Migrate(context.Background(), src, dst); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = dst.Create(context.Background(), Item{ID: "extra"}); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = VerifyMigration(context.Background(), src, dst); !errors.Is(err, ErrorMigrationMismatch) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorMigrationMismatch, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestLockAndUnlock", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s, WithKeyCache(10, 0))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("record", testObj{A: "a"}); err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				sig, err := w.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				m := w.(*wallet).metadata
+				key := w.(*wallet).keys.get(kid)
+				b, err := w.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				w.Lock()
+
+				// Keys are wiped from memory
+				for _, secret := range [][]byte{m.HmacKey, m.ItemKeyKey, m.NameKey, key.Key, key.agreementKey[:]} {
+					for _, c := range secret {
+						if c != 0 {
+							t.Fatal("Expected the keys to be wiped")
+						}
+					}
+				}
+
+				var obj testObj
+				if err = w.Read("record", &obj); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+				if _, err = w.Sign(kid, []byte("message")); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+				if w.Verify(kid, []byte("message"), sig) || w.KeyExists(kid) {
+					t.Fatal("Expected a locked wallet to hold no keys")
+				}
+				if err = b.Create("batched", testObj{A: "b"}); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+				if _, err = w.NewBatch(); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+				if err = w.Rekey("supersecret", "newsecret"); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+
+				if err = w.Unlock("wrongpassword"); err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidPassword, err)
+				}
+				if err = w.Unlock("supersecret"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Read("record", &obj); err != nil {
+					t.Fatal(err.Error())
+				}
+				if !w.Verify(kid, []byte("message"), sig) {
+					t.Fatal("Expected the signature to verify once unlocked")
+				}
+
+				// A batch started before Lock cannot be committed after Unlock
+				if err = b.Commit(); err != errorRekeyed {
+					t.Fatalf("Expected: %v, Actual: %v", errorRekeyed, err)
+				}
+				empty := &Batch{w: w.(*wallet)}
+				if err = empty.Commit(); err != errorRekeyed {
+					t.Fatalf("Expected: %v, Actual: %v", errorRekeyed, err)
+				}
+
+				if err = w.Close(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Unlock("supersecret"); err == nil {
+					t.Fatal("Expected a closed wallet not to unlock")
+				}
+				if err = w.Read("record", &obj); err != ErrorLocked {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestAutoLock", func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "wrapper")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer os.RemoveAll(dir)
+
+				wrapper, err := NewFileWrapper(filepath.Join(dir, "wrapping.key"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				s := db.Setup()
+				w, err := NewWalletWithWrapper(s, wrapper, WithAutoLock(100*time.Millisecond))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.Create("record", testObj{A: "a"}); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				locked := func() bool {
+					state := w.(*wallet).walletState
+					state.mu.RLock()
+					defer state.mu.RUnlock()
+					return state.metadata == nil
+				}
+				for i := 0; i < 2; i++ {
+					deadline := time.Now().Add(5 * time.Second)
+					for !locked() && time.Now().Before(deadline) {
+						time.Sleep(10 * time.Millisecond)
+					}
+
+					var obj testObj
+					if err = w.Read("record", &obj); err != ErrorLocked {
+						t.Fatalf("Expected: %v, Actual: %v", ErrorLocked, err)
+					}
+					// The wrapper unlocks the wallet, and the timer starts again
+					if err = w.Unlock(""); err != nil {
+						t.Fatal(err.Error())
+					}
+					if err = w.Read("record", &obj); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				w.Close()
+			})
+
+			db.Teardown()
+
+			t.Run("TestProfiles", func(t *testing.T) {
+				s := db.Setup()
+				m := NewManager(s)
+				ctx := context.Background()
+
+				alice, err := m.CreateProfile(ctx, "alice", "alicesecret")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				bob, err := m.CreateProfile(ctx, "bob", "bobsecret")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = m.CreateProfile(ctx, "alice", "alicesecret"); err != ErrorAlreadyExists {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorAlreadyExists, err)
+				}
+				if _, err = m.CreateProfile(ctx, "../alice", "alicesecret"); err != ErrorInvalidProfileName {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidProfileName, err)
+				}
+
+				// Profiles only see their own records and keys
+				for _, p := range []struct {
+					w    Wallet
+					name string
+				}{{alice, "alice"}, {bob, "bob"}} {
+					if err = p.w.Create("connection", testObj{A: p.name}, WithType("connection"), WithTags(Tags{"state": "active"})); err != nil {
+						t.Fatal(err.Error())
+					}
+					if _, err = p.w.CreateKey(Ed25519VerificationKey2018Type); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				b, err := bob.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = b.Create("invitation", testObj{A: "bob"}); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = b.Commit(); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				var obj testObj
+				if err = alice.Read("connection", &obj); err != nil || obj.A != "alice" {
+					t.Fatalf("Expected alice's record, Actual: %v %v", obj, err)
+				}
+				if err = alice.Read("invitation", &obj); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				records, err := bob.Search("connection", Query{"state": "active"})
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(records) != 1 || string(records[0].Value) != `{"a":"bob"}` {
+					t.Fatalf("Expected bob's record, Actual: %v", records)
+				}
+				keys, _, err := alice.ListKeys("", 10)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(keys) != 1 {
+					t.Fatalf("Expected: 1 key, Actual: %d", len(keys))
+				}
+
+				names, err := m.ListProfiles(ctx)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if !reflect.DeepEqual(names, []string{"alice", "bob"}) {
+					t.Fatalf("Expected: [alice bob], Actual: %v", names)
+				}
+
+				if _, err = m.OpenProfile(ctx, "alice", "bobsecret"); err != ErrorInvalidPassword {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorInvalidPassword, err)
+				}
+				if _, err = m.OpenProfile(ctx, "carol", "carolsecret"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+				if _, err = m.OpenProfile(cancelled, "bob", "bobsecret"); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Expected: %v, Actual: %v", context.Canceled, err)
+				}
+
+				if err = m.DeleteProfile(ctx, "alice"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = m.OpenProfile(ctx, "alice", "alicesecret"); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				if names, err = m.ListProfiles(ctx); err != nil {
+					t.Fatal(err.Error())
+				}
+				if !reflect.DeepEqual(names, []string{"bob"}) {
+					t.Fatalf("Expected: [bob], Actual: %v", names)
+				}
+
+				bob, err = m.OpenProfile(ctx, "bob", "bobsecret")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = bob.Read("invitation", &obj); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = bob.RekeyFull("bobsecret", "newsecret"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = m.OpenProfile(ctx, "bob", "newsecret"); err != nil {
+					t.Fatal(err.Error())
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestKeyRotation", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s, WithKeyCache(10, 0))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				sender, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				kid, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyDID("did:peer:1"), WithKeyPurpose("authentication"), WithKeyTags(Tags{"label": "alice"}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.UpdateKeyInfo(kid, WithKeyDID("did:peer:2")); err != nil {
+					t.Fatal(err.Error())
+				}
+				info, err := w.ReadKeyInfo(kid)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.DID != "did:peer:2" || info.Purpose != "authentication" || info.Tags["label"] != "alice" || info.Created.IsZero() || info.Retired() {
+					t.Fatalf("Unexpected key info: %+v", info)
+				}
+
+				sig, err := w.Sign(kid, []byte("message"))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				sealed, nonce, err := w.Seal([]byte("message"), kid, sender)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				newID, err := w.RotateKey(kid)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if newID == kid {
+					t.Fatal("Expected a new key")
+				}
+				if info, err = w.ReadKeyInfo(kid); err != nil {
+					t.Fatal(err.Error())
+				}
+				if !info.Retired() || info.ReplacedBy != newID || info.Rotated.IsZero() {
+					t.Fatalf("Expected the key to be retired, Actual: %+v", info)
+				}
+				if info, err = w.ReadKeyInfo(newID); err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.Replaces != kid || info.DID != "did:peer:2" || info.Purpose != "authentication" || info.Tags["label"] != "alice" {
+					t.Fatalf("Expected the metadata to carry over, Actual: %+v", info)
+				}
+
+				// The retired key no longer signs or seals, but still opens
+				// and verifies
+				if _, err = w.Sign(kid, []byte("message")); err != ErrorKeyRetired {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorKeyRetired, err)
+				}
+				if _, _, err = w.Seal([]byte("message"), sender, kid); err != ErrorKeyRetired {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorKeyRetired, err)
+				}
+				if msg, ok := w.Open(sealed, nonce[:], sender, kid); !ok || string(msg) != "message" {
+					t.Fatal("Expected the retired key to open the message")
+				}
+				if !w.Verify(kid, []byte("message"), sig) {
+					t.Fatal("Expected the signature of the retired key to verify")
+				}
+				if _, err = w.Sign(newID, []byte("message")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.RotateKey(kid); err != ErrorKeyRetired {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorKeyRetired, err)
+				}
+
+				symmetric, err := w.CreateKey(XChaCha20Poly1305KeyType)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				ciphertext, err := w.Encrypt(symmetric, []byte("secret"), nil)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.RotateKey(symmetric); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Encrypt(symmetric, []byte("secret"), nil); err != ErrorKeyRetired {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorKeyRetired, err)
+				}
+				if plaintext, err := w.Decrypt(symmetric, ciphertext, nil); err != nil || string(plaintext) != "secret" {
+					t.Fatalf("Expected the retired key to decrypt, Actual: %v", err)
+				}
+
+				keys, _, err := w.ListKeys("", 10)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(keys) != 5 {
+					t.Fatalf("Expected: 5 keys, Actual: %d", len(keys))
+				}
+
+				// Rotating derives the new key past the indexes taken by
+				// DeriveKey
+				if err = w.SetMasterSeed([]byte("0123456789abcdef0123456789abcdef")); err != nil {
+					t.Fatal(err.Error())
+				}
+				taken, err := w.DeriveKey(Ed25519VerificationKey2018Type, "m/0'/1'")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				derived, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for _, path := range []string{"m/0'/2'", "m/0'/3'"} {
+					if derived, err = w.RotateKey(derived); err != nil {
+						t.Fatal(err.Error())
+					}
+					if info, err = w.ReadKeyInfo(derived); err != nil {
+						t.Fatal(err.Error())
+					}
+					if derived == taken || info.Path != path {
+						t.Fatalf("Expected a key at %s, Actual: %s at %s", path, derived, info.Path)
+					}
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestKeyPolicy", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s, WithKeyCache(10, 0))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				issuer, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyPolicy(KeyPolicy{Usages: []KeyUsage{KeyUsageSign}, NonExportable: true}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				agreement, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyPolicy(KeyPolicy{Usages: []KeyUsage{KeyUsageKeyAgreement}}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				other, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// Issuer keys sign but cannot open messages, and the other
+				// way around
+				if _, err = w.Sign(issuer, []byte("credential")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(agreement, []byte("credential")); !errors.Is(err, ErrorPolicyViolation) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorPolicyViolation, err)
+				}
+				if _, _, err = w.Seal([]byte("message"), other, issuer); !errors.Is(err, ErrorPolicyViolation) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorPolicyViolation, err)
+				}
+				sealed, nonce, err := w.Seal([]byte("message"), issuer, other)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, ok := w.Open(sealed, nonce[:], other, issuer); ok {
+					t.Fatal("Expected the issuer key not to open messages")
+				}
+				if sealed, nonce, err = w.Seal([]byte("message"), agreement, other); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, ok := w.Open(sealed, nonce[:], other, agreement); !ok {
+					t.Fatal("Expected the key agreement key to open messages")
+				}
+
+				limited, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyPolicy(KeyPolicy{MaxUses: 2}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for i := 0; i < 2; i++ {
+					if _, err = w.Sign(limited, []byte("message")); err != nil {
+						t.Fatal(err.Error())
+					}
+				}
+				if _, err = w.Sign(limited, []byte("message")); !errors.Is(err, ErrorPolicyViolation) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorPolicyViolation, err)
+				}
+				info, err := w.ReadKeyInfo(limited)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.Uses != 2 {
+					t.Fatalf("Expected: 2 uses, Actual: %d", info.Uses)
+				}
+
+				// Messages that do not open do not use the key up
+				receiver, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyPolicy(KeyPolicy{MaxUses: 1}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				for i := 0; i < 3; i++ {
+					if _, ok := w.Open([]byte("forged message"), nonce[:], other, receiver); ok {
+						t.Fatal("Expected the forged message not to open")
+					}
+					if _, ok := w.OpenAnonymous([]byte("forged message"), receiver); ok {
+						t.Fatal("Expected the forged message not to open")
+					}
+				}
+				genuine, genuineNonce, err := w.Seal([]byte("message"), receiver, other)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, ok := w.Open(genuine, genuineNonce[:], other, receiver); !ok {
+					t.Fatal("Expected the genuine message to open")
+				}
+				if _, ok := w.Open(genuine, genuineNonce[:], other, receiver); ok {
+					t.Fatal("Expected the key to be used up")
+				}
+
+				expired, err := w.CreateKey(Ed25519VerificationKey2018Type, WithKeyPolicy(KeyPolicy{Expires: time.Now().Add(-time.Hour)}))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(expired, []byte("message")); !errors.Is(err, ErrorPolicyViolation) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorPolicyViolation, err)
+				}
+
+				// Policies can be added but not changed
+				if err = w.UpdateKeyInfo(issuer, WithKeyPolicy(KeyPolicy{})); !errors.Is(err, ErrorPolicyViolation) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorPolicyViolation, err)
+				}
+				if err = w.UpdateKeyInfo(other, WithKeyPolicy(KeyPolicy{Usages: []KeyUsage{KeyUsageSign}})); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, ok := w.Open(sealed, nonce[:], agreement, other); ok {
+					t.Fatal("Expected the new policy to apply")
+				}
+
+				rotated, err := w.RotateKey(issuer)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if info, err = w.ReadKeyInfo(rotated); err != nil {
+					t.Fatal(err.Error())
+				}
+				if info.Policy == nil || !info.Policy.NonExportable {
+					t.Fatalf("Expected the policy to carry over, Actual: %+v", info.Policy)
+				}
+
+				// Non-exportable keys are left out of exports
+				tmp, err := ioutil.TempDir("", "export")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer os.RemoveAll(tmp)
+				path := filepath.Join(tmp, "wallet.export")
+				if err = w.Export(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+				restored, err := NewWallet("supersecret", NewInMemoryStorage())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = restored.Import(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if restored.KeyExists(issuer) || restored.KeyExists(rotated) || !restored.KeyExists(agreement) {
+					t.Fatal("Expected only exportable keys to be exported")
+				}
+			})
+
+			db.Teardown()
+
+			t.Run("TestAuditLog", func(t *testing.T) {
+				s := db.Setup()
+				w, err := NewWallet("supersecret", s, WithAuditLog())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				cw := w.WithContext(ContextWithCaller(context.Background(), "issuer"))
+
+				signer, err := cw.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = cw.Sign(signer, []byte("credential")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = cw.Sign("missing", []byte("credential")); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+				receiver, err := w.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				sealed, nonce, err := cw.Seal([]byte("message"), receiver, signer)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, ok := w.Open(sealed, nonce[:], signer, receiver); !ok {
+					t.Fatal("Expected the message to open")
+				}
+				b, err := cw.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				batchKey, err := b.CreateKey(Ed25519VerificationKey2018Type)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = b.Commit(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = cw.DeleteKey(signer); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				expected := []AuditEntry{
+					{Operation: AuditCreateKey, KeyID: signer, Caller: "issuer"},
+					{Operation: AuditSign, KeyID: signer, Caller: "issuer"},
+					{Operation: AuditSign, KeyID: "missing", Caller: "issuer", Error: ErrorNotFound.Error()},
+					{Operation: AuditCreateKey, KeyID: receiver},
+					{Operation: AuditSeal, KeyID: signer, Caller: "issuer"},
+					{Operation: AuditOpen, KeyID: receiver},
+					{Operation: AuditCreateKey, KeyID: batchKey, Caller: "issuer"},
+					{Operation: AuditDeleteKey, KeyID: signer, Caller: "issuer"},
+				}
+				entries, err := w.ReadAuditLog(0, 100)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(entries) != len(expected) {
+					t.Fatalf("Expected: %d entries, Actual: %d", len(expected), len(entries))
+				}
+				for n, e := range entries {
+					x := expected[n]
+					if e.Seq != uint64(n+1) || e.Operation != x.Operation || e.KeyID != x.KeyID || e.Caller != x.Caller || e.Error != x.Error || e.Time.IsZero() {
+						t.Fatalf("Expected: %+v, Actual: %+v", x, e)
+					}
+				}
+				if err = w.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// The log is kept across openings of the wallet
+				w, err = NewWallet("supersecret", s, WithAuditLog())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(receiver, []byte("credential")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if entries, err = w.ReadAuditLog(8, 10); err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(entries) != 2 || entries[1].Operation != AuditSign || entries[1].KeyID != receiver || !bytes.Equal(entries[1].PrevHash, entries[0].Hash) {
+					t.Fatalf("Unexpected entries: %+v", entries)
+				}
+
+				// Changing an entry breaks the chain
+				id := fmt.Sprintf(auditEntryIdFmt, 2)
+				var entry AuditEntry
+				if err = w.(*wallet).read(id, &entry); err != nil {
+					t.Fatal(err.Error())
+				}
+				forged := entry
+				forged.Caller = "someone else"
+				if err = w.(*wallet).update(id, forged); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); !errors.Is(err, ErrorAuditLogTampered) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorAuditLogTampered, err)
+				}
+				if err = w.(*wallet).update(id, entry); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// So does removing the last entry
+				if err = w.(*wallet).delete(fmt.Sprintf(auditEntryIdFmt, 9)); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); !errors.Is(err, ErrorAuditLogTampered) {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorAuditLogTampered, err)
+				}
+
+				// A repair restores the chain and is recorded
+				if err = w.RepairAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if entries, err = w.ReadAuditLog(9, 10); err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(entries) != 1 || entries[0].Operation != AuditRepair || !strings.Contains(entries[0].Error, "entry 9 is missing") {
+					t.Fatalf("Unexpected entries: %+v", entries)
+				}
+
+				// The records of the log are out of reach of the record and
+				// key APIs
+				if err = w.Delete(auditHeadId); err != errorAuditRecord {
+					t.Fatalf("Expected: %v, Actual: %v", errorAuditRecord, err)
+				}
+				if err = w.Update(id, forged); err != errorAuditRecord {
+					t.Fatalf("Expected: %v, Actual: %v", errorAuditRecord, err)
+				}
+				if err = w.Read(id, &entry); err != errorAuditRecord {
+					t.Fatalf("Expected: %v, Actual: %v", errorAuditRecord, err)
+				}
+				b, err = w.NewBatch()
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = b.Delete(auditHeadId); err != errorAuditRecord {
+					t.Fatalf("Expected: %v, Actual: %v", errorAuditRecord, err)
+				}
+				if err = w.DeleteKey("../" + auditHeadId); err != ErrorNotFound {
+					t.Fatalf("Expected: %v, Actual: %v", ErrorNotFound, err)
+				}
+
+				// A log that lost its head refuses to record, until repaired
+				if err = w.(*wallet).delete(auditHeadId); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(receiver, []byte("credential")); err == nil {
+					t.Fatal("Expected signing to fail while the log is broken")
+				}
+				if err = w.RepairAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.Sign(receiver, []byte("credential")); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = w.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// The log stays with its wallet when exported
+				tmp, err := ioutil.TempDir("", "export")
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				defer os.RemoveAll(tmp)
+				path := filepath.Join(tmp, "export")
+				if err = w.Export(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+				other, err := NewWallet("othersecret", NewInMemoryStorage(), WithAuditLog())
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = other.CreateKey(Ed25519VerificationKey2018Type); err != nil {
+					t.Fatal(err.Error())
+				}
+				if err = other.Import(path, "exportkey"); err != nil {
+					t.Fatal(err.Error())
+				}
+				if entries, err = other.ReadAuditLog(0, 100); err != nil {
+					t.Fatal(err.Error())
+				}
+				if len(entries) != 1 {
+					t.Fatalf("Expected: 1 entry, Actual: %d", len(entries))
+				}
+				if err = other.VerifyAuditLog(); err != nil {
+					t.Fatal(err.Error())
+				}
+
+				// Wallets opened without the option neither record nor read
+				// the log
+				w, err = NewWallet("supersecret", s)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				if _, err = w.ReadAuditLog(0, 10); err == nil {
+					t.Fatal("Expected an error")
+				}
+
+				db.Teardown()
+			})
 		})
 	}
 }
@@ -3,6 +3,6 @@ package wallet
 // Implementations of the Wrapper interface should wrap secrets by
 // encrypting them with keys stored in a secure enclave or HSM.
 type Wrapper interface {
-	Wrap(secret []byte) (wrappedSecret []byte)
-	Unwrap(wrappedSecret []byte) (secret []byte)
+	Wrap(secret []byte) (wrappedSecret []byte, err error)
+	Unwrap(wrappedSecret []byte) (secret []byte, err error)
 }